@@ -0,0 +1,192 @@
+package mpdsub
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// archiveExts are the file extensions of archives which MPD can index, and
+// which osFilesystem can open files from.
+var archiveExts = map[string]struct{}{
+	".zip": {},
+}
+
+// findArchive splits a path such as "album.zip/01.flac" into the path of an
+// archive file and the path of an entry within it.  It returns false if the
+// path does not traverse an archive file.
+func findArchive(name string) (archive string, entry string, ok bool) {
+	elems := strings.Split(name, string(os.PathSeparator))
+
+	// The final element is the entry itself, so it can't be an archive
+	for i, e := range elems[:len(elems)-1] {
+		if _, ok := archiveExts[strings.ToLower(filepath.Ext(e))]; !ok {
+			continue
+		}
+
+		// Directories may also have an archive's extension
+		archive = strings.Join(elems[:i+1], string(os.PathSeparator))
+		if fi, err := os.Stat(archive); err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+
+		// Zip entries always use forward slashes
+		entry = strings.Join(elems[i+1:], "/")
+		return archive, entry, true
+	}
+
+	return "", "", false
+}
+
+// openArchiveEntry opens the entry with the input name in the zip archive
+// at path p.
+func openArchiveEntry(p string, name string) (file, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(f, stat.Size())
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	for _, zf := range zr.File {
+		if zf.Name != name || zf.FileInfo().IsDir() {
+			continue
+		}
+
+		af := &archiveFile{
+			f:  f,
+			fi: zf.FileInfo(),
+		}
+
+		// Uncompressed entries can be read directly from the archive, but
+		// compressed entries must be decompressed as they are read
+		size := int64(zf.UncompressedSize64)
+		if off, err := zf.DataOffset(); err == nil && zf.Method == zip.Store {
+			af.ReadSeeker = io.NewSectionReader(f, off, size)
+		} else {
+			af.ReadSeeker = &zipEntryReader{
+				zf:   zf,
+				size: size,
+			}
+		}
+
+		return af, nil
+	}
+
+	_ = f.Close()
+	return nil, &os.PathError{
+		Op:   "open",
+		Path: filepath.Join(p, name),
+		Err:  os.ErrNotExist,
+	}
+}
+
+var _ file = &archiveFile{}
+
+// An archiveFile is a file which is stored within an archive.
+type archiveFile struct {
+	io.ReadSeeker
+
+	f  *os.File
+	fi os.FileInfo
+}
+
+// Close closes the underlying archive.
+func (f *archiveFile) Close() error { return f.f.Close() }
+
+// Stat returns information about the entry within the archive.
+func (f *archiveFile) Stat() (os.FileInfo, error) { return f.fi, nil }
+
+// A zipEntryReader is an io.ReadSeeker for a compressed zip entry.
+//
+// Seeking is performed lazily on the next read, by discarding decompressed
+// data or by reopening the entry when seeking backwards.  This enables cheap
+// size probing using io.SeekEnd, as done by http.ServeContent.
+type zipEntryReader struct {
+	zf   *zip.File
+	size int64
+
+	rc     io.ReadCloser
+	pos    int64
+	target int64
+}
+
+// Read implements io.Reader.
+func (r *zipEntryReader) Read(b []byte) (int, error) {
+	if r.target >= r.size {
+		return 0, io.EOF
+	}
+
+	// Rewind by reopening the entry
+	if r.target < r.pos && r.rc != nil {
+		_ = r.rc.Close()
+		r.rc = nil
+	}
+
+	if r.rc == nil {
+		rc, err := r.zf.Open()
+		if err != nil {
+			return 0, err
+		}
+
+		r.rc = rc
+		r.pos = 0
+	}
+
+	if r.target > r.pos {
+		n, err := io.CopyN(ioutil.Discard, r.rc, r.target-r.pos)
+		r.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.rc.Read(b)
+	r.pos += int64(n)
+	r.target = r.pos
+
+	// The entry's decompressor is closed when the archive is closed, but
+	// release it early once it has been fully consumed
+	if err == io.EOF {
+		_ = r.rc.Close()
+		r.rc = nil
+	}
+
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *zipEntryReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.target + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if abs < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.target = abs
+	return abs, nil
+}
@@ -0,0 +1,141 @@
+package mpdsub
+
+import (
+	"archive/zip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOSFilesystemArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mpdsub")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create an archive with both stored and compressed entries
+	f, err := os.Create(filepath.Join(dir, "album.zip"))
+	if err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+
+	zw := zip.NewWriter(f)
+	for _, e := range []struct {
+		name   string
+		method uint16
+	}{
+		{name: "01.flac", method: zip.Store},
+		{name: "CD2/02.flac", method: zip.Deflate},
+	} {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   e.name,
+			Method: e.method,
+		})
+		if err != nil {
+			t.Fatalf("failed to create archive entry: %v", err)
+		}
+
+		if _, err := io.WriteString(w, "hello world"); err != nil {
+			t.Fatalf("failed to write archive entry: %v", err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatalf("failed to close archive: %v", err)
+	}
+	_ = f.Close()
+
+	fs := &osFilesystem{}
+
+	tests := []struct {
+		name string
+		file string
+		ok   bool
+	}{
+		{
+			name: "stored",
+			file: "album.zip/01.flac",
+			ok:   true,
+		},
+		{
+			name: "compressed",
+			file: "album.zip/CD2/02.flac",
+			ok:   true,
+		},
+		{
+			name: "missing entry",
+			file: "album.zip/03.flac",
+		},
+		{
+			name: "directory entry",
+			file: "album.zip/CD2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, tt.file)
+
+			f, err := fs.Open(p)
+			if err != nil {
+				if tt.ok {
+					t.Fatalf("failed to open archive entry: %v", err)
+				}
+				if !os.IsNotExist(err) {
+					t.Fatalf("expected does not exist error, but got: %v", err)
+				}
+
+				return
+			}
+			defer f.Close()
+			if !tt.ok {
+				t.Fatal("expected an error, but none occurred")
+			}
+
+			rp, err := fs.EvalSymlinks(p)
+			if err != nil {
+				t.Fatalf("failed to evaluate symbolic links: %v", err)
+			}
+			if want, got := filepath.Base(p), filepath.Base(rp); want != got {
+				t.Fatalf("unexpected resolved path:\n- want: %q\n-  got: %q", want, got)
+			}
+
+			stat, err := f.Stat()
+			if err != nil {
+				t.Fatalf("failed to stat archive entry: %v", err)
+			}
+			if want, got := int64(len("hello world")), stat.Size(); want != got {
+				t.Fatalf("unexpected entry size:\n- want: %v\n-  got: %v", want, got)
+			}
+
+			// Serve each entry twice to ensure ranges work, even after
+			// the entry has been read completely
+			for _, rng := range []string{"bytes=6-", "bytes=0-4"} {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.Header.Set("Range", rng)
+
+				w := httptest.NewRecorder()
+				http.ServeContent(w, req, p, time.Time{}, f)
+
+				if want, got := http.StatusPartialContent, w.Code; want != got {
+					t.Fatalf("unexpected HTTP status code:\n- want: %03d\n-  got: %03d", want, got)
+				}
+
+				want := map[string]string{
+					"bytes=6-":  "world",
+					"bytes=0-4": "hello",
+				}[rng]
+
+				if got := w.Body.String(); want != got {
+					t.Fatalf("unexpected range body:\n- want: %q\n-  got: %q", want, got)
+				}
+			}
+		})
+	}
+}
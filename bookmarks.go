@@ -0,0 +1,160 @@
+package mpdsub
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A bookmark is a position saved by a user within a file.
+type bookmark struct {
+	fileRef
+
+	Position int64     `json:"position"`
+	Comment  string    `json:"comment,omitempty"`
+	Created  time.Time `json:"created"`
+	Changed  time.Time `json:"changed"`
+}
+
+// createBookmark creates or updates a bookmark at a position in milliseconds
+// within a file, for the requesting user.
+func (s *Server) createBookmark(w http.ResponseWriter, r *http.Request) {
+	qID := r.Form.Get("id")
+	qPosition := r.Form.Get("position")
+	if qID == "" || qPosition == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	position, err := strconv.ParseInt(qPosition, 10, 64)
+	if err != nil || position < 0 {
+		writeXML(w, errGeneric)
+		return
+	}
+
+	folder, _, file, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return
+	}
+	if file.Dir {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	u := requestUser(r)
+	ref := fileRef{Folder: folder.ID, Name: file.Name}
+	now := time.Now()
+
+	err = s.state.update(func(st *state) {
+		if st.Bookmarks == nil {
+			st.Bookmarks = make(map[string][]bookmark)
+		}
+
+		bs := st.Bookmarks[u.Name]
+		for i := range bs {
+			if bs[i].fileRef == ref {
+				bs[i].Position = position
+				bs[i].Comment = r.Form.Get("comment")
+				bs[i].Changed = now
+				return
+			}
+		}
+
+		st.Bookmarks[u.Name] = append(bs, bookmark{
+			fileRef:  ref,
+			Position: position,
+			Comment:  r.Form.Get("comment"),
+			Created:  now,
+			Changed:  now,
+		})
+	})
+	if err != nil {
+		s.logf("error saving bookmark: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	writeXML(w, nil)
+}
+
+// getBookmarks returns all of the requesting user's bookmarks.  Bookmarks for
+// files which no longer exist or which the user can no longer access are
+// omitted.
+func (s *Server) getBookmarks(w http.ResponseWriter, r *http.Request) {
+	u := requestUser(r)
+
+	var bs []bookmark
+	s.state.view(func(st *state) {
+		bs = append(bs, st.Bookmarks[u.Name]...)
+	})
+
+	refs := make([]fileRef, 0, len(bs))
+	for _, b := range bs {
+		refs = append(refs, b.fileRef)
+	}
+
+	children, err := s.resolveRefs(u, refs)
+	if err != nil {
+		s.logf("error resolving files from mpd for getting bookmarks: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	entries := make([]bookmarkEntry, 0, len(bs))
+	for _, b := range bs {
+		entry, ok := children[b.fileRef]
+		if !ok {
+			continue
+		}
+
+		entries = append(entries, bookmarkEntry{
+			Position: b.Position,
+			Username: u.Name,
+			Comment:  b.Comment,
+			Created:  b.Created,
+			Changed:  b.Changed,
+			Entry:    entry,
+		})
+	}
+
+	writeXML(w, func(c *container) {
+		c.Bookmarks = &bookmarksContainer{
+			Bookmarks: entries,
+		}
+	})
+}
+
+// deleteBookmark deletes the requesting user's bookmark for a file, if one
+// exists.
+func (s *Server) deleteBookmark(w http.ResponseWriter, r *http.Request) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	folder, _, file, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return
+	}
+
+	u := requestUser(r)
+	ref := fileRef{Folder: folder.ID, Name: file.Name}
+
+	err := s.state.update(func(st *state) {
+		bs := st.Bookmarks[u.Name]
+		for i := range bs {
+			if bs[i].fileRef == ref {
+				st.Bookmarks[u.Name] = append(bs[:i], bs[i+1:]...)
+				return
+			}
+		}
+	})
+	if err != nil {
+		s.logf("error deleting bookmark: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	writeXML(w, nil)
+}
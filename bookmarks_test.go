@@ -0,0 +1,172 @@
+package mpdsub
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+func TestServerBookmarks(t *testing.T) {
+	db := &memoryDatabase{
+		files: []string{"a.mp3", "b.mp3"},
+		attrs: map[string]mpd.Attrs{
+			"a.mp3":  {"TITLE": "A"},
+			"b.mp3":  {"TITLE": "B"},
+			"0.mp3":  {"TITLE": "0"},
+			"00.mp3": {"TITLE": "00"},
+		},
+	}
+
+	cfg := &Config{
+		Users: []User{
+			{Name: "test", Password: "test"},
+			{Name: "other", Password: "other"},
+		},
+	}
+
+	auth := func(user string, kv ...string) url.Values {
+		v := url.Values{
+			"u": []string{user},
+			"p": []string{user},
+			"c": []string{"test"},
+			"v": []string{"1.14.0"},
+		}
+		for i := 0; i < len(kv); i += 2 {
+			v.Set(kv[i], kv[i+1])
+		}
+
+		return v
+	}
+
+	withServer(t, db, nil, cfg, func(base string) {
+		get := func(user string) []bookmarkEntry {
+			c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/getBookmarks.view", auth(user)))
+			return c.Bookmarks.Bookmarks
+		}
+
+		errTests := []struct {
+			name   string
+			values url.Values
+			code   int
+		}{
+			{
+				name:   "no ID",
+				values: auth("test", "position", "1000"),
+				code:   codeMissingParameter,
+			},
+			{
+				name:   "no position",
+				values: auth("test", "id", "1"),
+				code:   codeMissingParameter,
+			},
+			{
+				name:   "bad position",
+				values: auth("test", "id", "1", "position", "-1"),
+				code:   codeGeneric,
+			},
+			{
+				name:   "not found",
+				values: auth("test", "id", "9", "position", "1000"),
+				code:   codeNotFound,
+			},
+		}
+
+		for _, tt := range errTests {
+			c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/createBookmark.view", tt.values))
+			if want, got := tt.code, c.Error.Code; want != got {
+				t.Fatalf("%s: unexpected error code:\n- want: %v\n-  got: %v", tt.name, want, got)
+			}
+		}
+
+		for _, pos := range []string{"1000", "2000"} {
+			c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/createBookmark.view",
+				auth("test", "id", "1", "position", pos, "comment", "halfway")))
+			if want, got := statusOK, c.Status; want != got {
+				t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+			}
+		}
+
+		bs := get("test")
+		if want, got := 1, len(bs); want != got {
+			t.Fatalf("unexpected number of bookmarks:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		b := bs[0]
+		if b.Position != 2000 || b.Username != "test" || b.Comment != "halfway" ||
+			b.Entry.ID != "1" || b.Entry.Title != "B" {
+			t.Fatalf("unexpected bookmark: %+v", b)
+		}
+
+		if want, got := 0, len(get("other")); want != got {
+			t.Fatalf("unexpected number of bookmarks for other user:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		// Adding files to the database changes IDs, but bookmarks must
+		// still refer to the same file
+		db.mu.Lock()
+		db.files = []string{"0.mp3", "00.mp3", "a.mp3", "b.mp3"}
+		db.mu.Unlock()
+
+		bs = get("test")
+		if want, got := "3", bs[0].Entry.ID; want != got {
+			t.Fatalf("unexpected bookmark entry ID:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/deleteBookmark.view", auth("test", "id", "3")))
+		if want, got := statusOK, c.Status; want != got {
+			t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+		}
+
+		if want, got := 0, len(get("test")); want != got {
+			t.Fatalf("unexpected number of bookmarks after delete:\n- want: %v\n-  got: %v", want, got)
+		}
+	})
+}
+
+func TestServerBookmarksPersisted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mpdsub")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	db := &memoryDatabase{
+		files: []string{"a.mp3"},
+		attrs: map[string]mpd.Attrs{
+			"a.mp3": {"TITLE": "A"},
+		},
+	}
+
+	cfg, values := configAuth()
+	cfg.StateDirectory = dir
+
+	withServer(t, db, nil, cfg, func(base string) {
+		v := url.Values{"id": []string{"0"}, "position": []string{"1000"}}
+		for k := range values {
+			v.Set(k, values.Get(k))
+		}
+
+		c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/createBookmark.view", v))
+		if want, got := statusOK, c.Status; want != got {
+			t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+		}
+	})
+
+	// A new Server must load the bookmark created by the previous one
+	withServer(t, db, nil, cfg, func(base string) {
+		c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/getBookmarks.view", values))
+
+		bs := c.Bookmarks.Bookmarks
+		if want, got := 1, len(bs); want != got {
+			t.Fatalf("unexpected number of bookmarks:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		if want, got := int64(1000), bs[0].Position; want != got {
+			t.Fatalf("unexpected bookmark position:\n- want: %v\n-  got: %v", want, got)
+		}
+	})
+}
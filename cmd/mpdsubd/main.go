@@ -2,9 +2,14 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/fhs/gompd/mpd"
@@ -16,10 +21,29 @@ func main() {
 		mpdNetwork  string
 		mpdAddr     string
 		mpdMusicDir string
+		mpdFolders  folderFlags
+		mpdMounts   mountFlags
+		symlinks    string
 
-		user string
-		pass string
-		addr string
+		user      string
+		pass      string
+		apiKeys   string
+		usersFile string
+		addr      string
+
+		generateAPIKey bool
+
+		proxyHeader  string
+		proxyTrusted string
+
+		ffmpeg          string
+		transcodeFormat string
+		transcodeRate   int
+
+		stateDir   string
+		podcastDir string
+
+		partition string
 
 		verbose bool
 	)
@@ -27,25 +51,147 @@ func main() {
 	flag.StringVar(&mpdNetwork, "mpd.network", "tcp", "network to use to dial MPD (typically 'tcp' or 'unix')")
 	flag.StringVar(&mpdAddr, "mpd.addr", "localhost:6600", "address of MPD server")
 	flag.StringVar(&mpdMusicDir, "mpd.music.dir", "", "location of MPD's music directory")
+	flag.StringVar(&symlinks, "mpd.music.symlinks", "within", "how to handle symbolic links in music directories: 'within' (only targets within the music directory), 'follow', or 'deny'")
+	flag.Var(&mpdMounts, "mpd.mount", "MPD storage mount to proxy over HTTP when streaming, as 'mountpoint=http://base/url' (may be repeated)")
+	flag.Var(&mpdFolders, "mpd.folder", "additional MPD server to expose as a music folder, as 'name,network,addr,music.dir' (may be repeated)")
 
 	flag.StringVar(&user, "user", "", "username for authentication to this server")
 	flag.StringVar(&pass, "pass", "", "password for authentication to this server")
+	flag.StringVar(&apiKeys, "apikeys", "", "comma-separated list of hashed API keys for authentication to this server")
+	flag.StringVar(&usersFile, "users", "", "path to a JSON file listing users, their credentials, roles, and directories")
+	flag.BoolVar(&generateAPIKey, "apikey.generate", false, "generate a new API key and its hash, then exit")
 	flag.StringVar(&addr, "addr", ":4040", "address this server will listen on")
 
+	flag.StringVar(&proxyHeader, "proxy.header", "", "HTTP header carrying a username authenticated by a trusted reverse proxy (e.g. 'X-Forwarded-User')")
+	flag.StringVar(&proxyTrusted, "proxy.trusted", "", "comma-separated list of CIDRs of reverse proxies trusted to set -proxy.header")
+
+	flag.StringVar(&ffmpeg, "transcode.ffmpeg", "", "path to ffmpeg binary used to transcode streams (transcoding disabled if empty)")
+	flag.StringVar(&transcodeFormat, "transcode.format", "mp3", "format used to transcode streams when clients only request a maximum bitrate")
+	flag.IntVar(&transcodeRate, "transcode.bitrate", 192, "default bitrate in kbps for transcoded streams")
+
+	flag.StringVar(&stateDir, "state.dir", "", "directory in which to persist state such as bookmarks (state kept in memory if empty)")
+	flag.StringVar(&podcastDir, "podcast.dir", "", "directory relative to -mpd.music.dir into which podcast episodes are downloaded (podcasts disabled if empty)")
+
+	flag.StringVar(&partition, "playqueue.partition", "", "MPD partition into which saved play queues are mirrored (mirroring disabled if empty)")
+
 	flag.BoolVar(&verbose, "v", false, "enable verbose logging")
 
 	flag.Parse()
 
+	if generateAPIKey {
+		key, err := mpdsub.GenerateAPIKey()
+		if err != nil {
+			log.Fatalf("failed to generate API key: %v", err)
+		}
+
+		fmt.Printf("key:  %s\nhash: %s\n", key, mpdsub.HashAPIKey(key))
+		return
+	}
+
+	var users []mpdsub.User
+	if user != "" {
+		u := mpdsub.User{
+			Name:     user,
+			Password: pass,
+			Roles:    mpdsub.RoleAdmin,
+		}
+		if apiKeys != "" {
+			u.APIKeys = strings.Split(apiKeys, ",")
+		}
+
+		users = append(users, u)
+	}
+
+	if usersFile != "" {
+		us, err := readUsers(usersFile)
+		if err != nil {
+			log.Fatalf("failed to read users file: %v", err)
+		}
+
+		users = append(users, us...)
+	}
+
+	var trusted []*net.IPNet
+	if proxyTrusted != "" {
+		for _, cidr := range strings.Split(proxyTrusted, ",") {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				log.Fatalf("failed to parse trusted proxy CIDR: %v", err)
+			}
+
+			trusted = append(trusted, n)
+		}
+	}
+
+	policies := map[string]mpdsub.SymlinkPolicy{
+		"within": mpdsub.SymlinksWithinRoot,
+		"follow": mpdsub.SymlinksFollow,
+		"deny":   mpdsub.SymlinksDeny,
+	}
+	policy, ok := policies[symlinks]
+	if !ok {
+		log.Fatalf("unknown symbolic link policy: %q", symlinks)
+	}
+
+	var transcoder mpdsub.Transcoder
+	if ffmpeg != "" {
+		transcoder = ffmpegTranscoder(ffmpeg, transcodeRate)
+	}
+
 	c, err := mpd.Dial(mpdNetwork, mpdAddr)
 	if err != nil {
 		log.Fatalf("failed to dial MPD: %v", err)
 	}
 	log.Printf("connected to MPD: %s://%s", mpdNetwork, mpdAddr)
 
+	// Mirror play queues using a dedicated connection, because switching
+	// partitions applies to the entire connection
+	var player mpdsub.Player
+	if partition != "" {
+		pc, err := mpd.Dial(mpdNetwork, mpdAddr)
+		if err != nil {
+			log.Fatalf("failed to dial MPD for play queue partition: %v", err)
+		}
+
+		// The partition may already exist, so only switching to it must succeed
+		_ = pc.Command("newpartition %s", partition).OK()
+		if err := pc.Command("partition %s", partition).OK(); err != nil {
+			log.Fatalf("failed to switch to MPD partition %q: %v", partition, err)
+		}
+		log.Printf("mirroring play queues to MPD partition: %s", partition)
+
+		player = pc
+	}
+
+	var folders []mpdsub.Folder
+	for _, f := range mpdFolders {
+		fc, err := mpd.Dial(f.network, f.addr)
+		if err != nil {
+			log.Fatalf("failed to dial MPD for folder %q: %v", f.name, err)
+		}
+		log.Printf("connected to MPD for folder %q: %s://%s", f.name, f.network, f.addr)
+
+		folders = append(folders, mpdsub.Folder{
+			Name:           f.name,
+			Client:         fc,
+			MusicDirectory: f.dir,
+		})
+	}
+
 	s := mpdsub.NewServer(c, &mpdsub.Config{
-		SubsonicUser:     user,
-		SubsonicPassword: pass,
+		Users:            users,
+		ProxyAuthHeader:  proxyHeader,
+		TrustedProxies:   trusted,
 		MusicDirectory:   mpdMusicDir,
+		Symlinks:         policy,
+		Mounts:           mpdMounts,
+		Folders:          folders,
+		Transcoder:       transcoder,
+		TranscodeFormat:  transcodeFormat,
+		TranscodeBitRate: transcodeRate,
+		StateDirectory:   stateDir,
+		PodcastDirectory: podcastDir,
+		Player:           player,
 		Verbose:          verbose,
 		Keepalive:        1 * time.Second,
 	})
@@ -55,3 +201,155 @@ func main() {
 		log.Fatalf("failed to start HTTP server: %v", err)
 	}
 }
+
+// A userEntry is a user specified in a users file.  Users without a password
+// or API keys may only authenticate using -proxy.header.
+type userEntry struct {
+	Name        string   `json:"name"`
+	Password    string   `json:"password"`
+	APIKeys     []string `json:"apiKeys"`
+	Roles       []string `json:"roles"`
+	Directories []string `json:"directories"`
+}
+
+// roles maps the names of roles in a users file to their values.
+var roles = map[string]mpdsub.Role{
+	"stream":   mpdsub.RoleStream,
+	"download": mpdsub.RoleDownload,
+	"jukebox":  mpdsub.RoleJukebox,
+	"playlist": mpdsub.RolePlaylist,
+	"coverArt": mpdsub.RoleCoverArt,
+	"settings": mpdsub.RoleSettings,
+	"admin":    mpdsub.RoleAdmin,
+	"podcast":  mpdsub.RolePodcast,
+	"share":    mpdsub.RoleShare,
+}
+
+// readUsers reads a JSON array of userEntry values from the file at path.
+func readUsers(path string) ([]mpdsub.User, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []userEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return nil, err
+	}
+
+	users := make([]mpdsub.User, 0, len(entries))
+	for _, e := range entries {
+		if e.Name == "" {
+			return nil, fmt.Errorf("user must have a name")
+		}
+
+		var role mpdsub.Role
+		for _, r := range e.Roles {
+			v, ok := roles[r]
+			if !ok {
+				return nil, fmt.Errorf("unknown role for user %q: %q", e.Name, r)
+			}
+
+			role |= v
+		}
+
+		users = append(users, mpdsub.User{
+			Name:        e.Name,
+			Password:    e.Password,
+			APIKeys:     e.APIKeys,
+			Roles:       role,
+			Directories: e.Directories,
+		})
+	}
+
+	return users, nil
+}
+
+// A folderFlag is an additional MPD server specified using a command-line flag.
+type folderFlag struct {
+	name    string
+	network string
+	addr    string
+	dir     string
+}
+
+// folderFlags implements flag.Value for a repeated set of folderFlags.
+type folderFlags []folderFlag
+
+func (fs *folderFlags) String() string {
+	ss := make([]string, 0, len(*fs))
+	for _, f := range *fs {
+		ss = append(ss, strings.Join([]string{f.name, f.network, f.addr, f.dir}, ","))
+	}
+
+	return strings.Join(ss, " ")
+}
+
+func (fs *folderFlags) Set(s string) error {
+	ss := strings.Split(s, ",")
+	if len(ss) != 4 {
+		return fmt.Errorf("folder must be specified as 'name,network,addr,music.dir', got: %q", s)
+	}
+
+	*fs = append(*fs, folderFlag{
+		name:    ss[0],
+		network: ss[1],
+		addr:    ss[2],
+		dir:     ss[3],
+	})
+
+	return nil
+}
+
+// ffmpegTranscoder creates a Transcoder which uses the ffmpeg binary at path
+// to produce common lossy formats.
+func ffmpegTranscoder(path string, bitRate int) mpdsub.Transcoder {
+	args := func(codec, format string, output ...string) []string {
+		args := []string{
+			path, "-v", "quiet", "-ss", "{offset}", "-t", "{duration}", "-i", "pipe:0",
+			"-map", "0:a:0", "-c:a", codec, "-b:a", "{bitrate}k",
+		}
+		args = append(args, output...)
+
+		return append(args, "-f", format, "pipe:1")
+	}
+
+	return &mpdsub.CommandTranscoder{
+		Commands: map[string][]string{
+			"mp3":  args("libmp3lame", "mp3"),
+			"ogg":  args("libvorbis", "ogg"),
+			"opus": args("libopus", "opus"),
+			// HLS segments are AAC in an MPEG transport stream, whose
+			// timestamps continue from the previous segment
+			"hls": args("aac", "mpegts", "-output_ts_offset", "{offset}"),
+		},
+		DefaultBitRate: bitRate,
+	}
+}
+
+// mountFlags implements flag.Value for a repeated set of MPD storage mounts.
+type mountFlags map[string]string
+
+func (ms *mountFlags) String() string {
+	ss := make([]string, 0, len(*ms))
+	for k, v := range *ms {
+		ss = append(ss, k+"="+v)
+	}
+
+	return strings.Join(ss, ",")
+}
+
+func (ms *mountFlags) Set(s string) error {
+	ss := strings.SplitN(s, "=", 2)
+	if len(ss) != 2 {
+		return fmt.Errorf("mount must be specified as 'mountpoint=http://base/url', got: %q", s)
+	}
+
+	if *ms == nil {
+		*ms = make(mountFlags)
+	}
+	(*ms)[ss[0]] = ss[1]
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package mpdsub
+
+import (
+	"net/http"
+)
+
+// An extension is an OpenSubsonic API extension implemented by the Server.
+type extension struct {
+	Name     string
+	Versions []int
+
+	// Enabled optionally reports whether a Server configured with cfg
+	// implements the extension.  If nil, the extension is always
+	// implemented.
+	Enabled func(cfg *Config) bool
+}
+
+// extensions is the registry of OpenSubsonic API extensions implemented by
+// the Server.  An extension must only be added here once the Server fully
+// implements it, because clients rely on this list to enable features.
+var extensions = []extension{
+	// API key authentication using the apiKey parameter.
+	{Name: "apiKeyAuthentication", Versions: []int{1}},
+	// Parameters may be sent in an application/x-www-form-urlencoded body.
+	{Name: "formPost", Versions: []int{1}},
+	// Structured, optionally synchronized lyrics using getLyricsBySongId.
+	{Name: "songLyrics", Versions: []int{1}},
+	// Transcoded streams may begin at the timeOffset parameter.
+	{
+		Name:     "transcodeOffset",
+		Versions: []int{1},
+		Enabled: func(cfg *Config) bool {
+			return cfg.Transcoder != nil
+		},
+	},
+}
+
+// getOpenSubsonicExtensions returns the OpenSubsonic API extensions which
+// are implemented by the Server, as it is configured.  It does not require
+// authentication, so clients may probe for extensions before logging in.
+func (s *Server) getOpenSubsonicExtensions(w http.ResponseWriter, r *http.Request) {
+	exts := make([]openSubsonicExtension, 0, len(extensions))
+	for _, e := range extensions {
+		if e.Enabled != nil && !e.Enabled(s.cfg) {
+			continue
+		}
+
+		exts = append(exts, openSubsonicExtension{
+			Name:     e.Name,
+			Versions: e.Versions,
+		})
+	}
+
+	writeXML(w, func(c *container) {
+		c.OpenSubsonicExtensions = exts
+	})
+}
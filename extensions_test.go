@@ -0,0 +1,68 @@
+package mpdsub
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestServer_getOpenSubsonicExtensions(t *testing.T) {
+	tests := []struct {
+		name       string
+		transcoder Transcoder
+		names      []string
+	}{
+		{
+			name:  "no transcoder",
+			names: []string{"apiKeyAuthentication", "formPost", "songLyrics"},
+		},
+		{
+			name:       "transcoder",
+			transcoder: &memoryTranscoder{},
+			names:      []string{"apiKeyAuthentication", "formPost", "songLyrics", "transcodeOffset"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, values := configAuth()
+			cfg.Transcoder = tt.transcoder
+
+			withServer(t, nil, nil, cfg, func(base string) {
+				c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/getOpenSubsonicExtensions.view", values))
+
+				var names []string
+				for _, e := range c.OpenSubsonicExtensions {
+					names = append(names, e.Name)
+
+					if want, got := []int{1}, e.Versions; !reflect.DeepEqual(want, got) {
+						t.Fatalf("unexpected %s versions:\n- want: %v\n-  got: %v", e.Name, want, got)
+					}
+				}
+
+				if want, got := tt.names, names; !reflect.DeepEqual(want, got) {
+					t.Fatalf("unexpected extensions:\n- want: %v\n-  got: %v", want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServer_getOpenSubsonicExtensionsUnauthenticated(t *testing.T) {
+	cfg, _ := configAuth()
+	withServer(t, nil, nil, cfg, func(base string) {
+		// Clients probe for extensions before they know which API
+		// versions the Server supports
+		values := url.Values{"v": []string{"1.99.0"}}
+		c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/getOpenSubsonicExtensions", values))
+
+		if want, got := statusOK, c.Status; want != got {
+			t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+		}
+
+		if len(c.OpenSubsonicExtensions) == 0 {
+			t.Fatal("expected one or more extensions")
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package mpdsub
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errUnknownFeed is returned when a podcast feed is neither RSS nor Atom.
+var errUnknownFeed = errors.New("unknown podcast feed format")
+
+// A feed is a podcast feed, parsed from RSS or Atom.
+type feed struct {
+	Title       string
+	Description string
+	ImageURL    string
+	Items       []feedItem
+}
+
+// A feedItem is a single podcast episode in a feed.  Items without an
+// enclosure cannot be downloaded.
+type feedItem struct {
+	GUID        string
+	Title       string
+	Description string
+	Published   time.Time
+	URL         string
+	ContentType string
+	Size        int64
+}
+
+// parseFeed parses an RSS or Atom podcast feed from r.
+func parseFeed(r io.Reader) (feed, error) {
+	d := xml.NewDecoder(r)
+
+	// Feeds are sometimes served with a charset other than UTF-8 declared,
+	// and most are ASCII compatible in practice
+	d.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) {
+		return r, nil
+	}
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			if err == io.EOF {
+				return feed{}, errUnknownFeed
+			}
+
+			return feed{}, err
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch se.Name.Local {
+		case "rss":
+			var v rssFeed
+			if err := d.DecodeElement(&v, &se); err != nil {
+				return feed{}, err
+			}
+
+			return v.feed(), nil
+		case "feed":
+			var v atomFeed
+			if err := d.DecodeElement(&v, &se); err != nil {
+				return feed{}, err
+			}
+
+			return v.feed(), nil
+		default:
+			return feed{}, errUnknownFeed
+		}
+	}
+}
+
+// An rssFeed is an RSS 2.0 feed, including common iTunes extensions.
+type rssFeed struct {
+	Channel struct {
+		Title       string `xml:"title"`
+		Description string `xml:"description"`
+
+		// The iTunes image must precede the RSS image, which would
+		// otherwise also match it
+		ITunesImage struct {
+			Href string `xml:"href,attr"`
+		} `xml:"http://www.itunes.com/dtds/podcast-1.0.dtd image"`
+		Image struct {
+			URL string `xml:"url"`
+		} `xml:"image"`
+
+		Items []struct {
+			GUID        string `xml:"guid"`
+			Title       string `xml:"title"`
+			Description string `xml:"description"`
+			PubDate     string `xml:"pubDate"`
+			Enclosure   struct {
+				URL    string `xml:"url,attr"`
+				Type   string `xml:"type,attr"`
+				Length string `xml:"length,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+// feed converts an rssFeed into a feed.
+func (v *rssFeed) feed() feed {
+	f := feed{
+		Title:       strings.TrimSpace(v.Channel.Title),
+		Description: strings.TrimSpace(v.Channel.Description),
+		ImageURL:    v.Channel.ITunesImage.Href,
+	}
+	if f.ImageURL == "" {
+		f.ImageURL = v.Channel.Image.URL
+	}
+
+	for _, it := range v.Channel.Items {
+		size, _ := strconv.ParseInt(it.Enclosure.Length, 10, 64)
+
+		f.Items = append(f.Items, feedItem{
+			GUID:        strings.TrimSpace(it.GUID),
+			Title:       strings.TrimSpace(it.Title),
+			Description: strings.TrimSpace(it.Description),
+			Published:   parseFeedTime(it.PubDate),
+			URL:         it.Enclosure.URL,
+			ContentType: it.Enclosure.Type,
+			Size:        size,
+		})
+	}
+
+	return f
+}
+
+// An atomFeed is an Atom feed, with episodes linked as enclosures.
+type atomFeed struct {
+	Title    string `xml:"title"`
+	Subtitle string `xml:"subtitle"`
+	Logo     string `xml:"logo"`
+	Entries  []struct {
+		ID        string `xml:"id"`
+		Title     string `xml:"title"`
+		Summary   string `xml:"summary"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+		Links     []struct {
+			Rel    string `xml:"rel,attr"`
+			Href   string `xml:"href,attr"`
+			Type   string `xml:"type,attr"`
+			Length string `xml:"length,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// feed converts an atomFeed into a feed.
+func (v *atomFeed) feed() feed {
+	f := feed{
+		Title:       strings.TrimSpace(v.Title),
+		Description: strings.TrimSpace(v.Subtitle),
+		ImageURL:    v.Logo,
+	}
+
+	for _, e := range v.Entries {
+		it := feedItem{
+			GUID:        strings.TrimSpace(e.ID),
+			Title:       strings.TrimSpace(e.Title),
+			Description: strings.TrimSpace(e.Summary),
+			Published:   parseFeedTime(e.Published),
+		}
+		if it.Published.IsZero() {
+			it.Published = parseFeedTime(e.Updated)
+		}
+
+		for _, l := range e.Links {
+			if l.Rel != "enclosure" {
+				continue
+			}
+
+			it.URL = l.Href
+			it.ContentType = l.Type
+			it.Size, _ = strconv.ParseInt(l.Length, 10, 64)
+			break
+		}
+
+		f.Items = append(f.Items, it)
+	}
+
+	return f
+}
+
+// feedTimeLayouts are the time layouts commonly found in podcast feeds.
+var feedTimeLayouts = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+}
+
+// parseFeedTime parses a time from a podcast feed.  It returns the zero time
+// if s cannot be parsed.
+func parseFeedTime(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,114 @@
+package mpdsub
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseFeed(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		f    feed
+		err  error
+	}{
+		{
+			name: "RSS",
+			in: `<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0" xmlns:itunes="http://www.itunes.com/dtds/podcast-1.0.dtd">
+	<channel>
+		<title> Podcast </title>
+		<description>About things</description>
+		<image><url>http://example.com/rss.png</url></image>
+		<itunes:image href="http://example.com/itunes.png"/>
+		<item>
+			<guid>1</guid>
+			<title>Episode 1</title>
+			<pubDate>Mon, 02 Jan 2006 15:04:05 -0700</pubDate>
+			<enclosure url="http://example.com/1.mp3" type="audio/mpeg" length="1024"/>
+		</item>
+		<item>
+			<title>No enclosure</title>
+		</item>
+	</channel>
+</rss>`,
+			f: feed{
+				Title:       "Podcast",
+				Description: "About things",
+				ImageURL:    "http://example.com/itunes.png",
+				Items: []feedItem{
+					{
+						GUID:        "1",
+						Title:       "Episode 1",
+						Published:   time.Date(2006, 1, 2, 22, 4, 5, 0, time.UTC),
+						URL:         "http://example.com/1.mp3",
+						ContentType: "audio/mpeg",
+						Size:        1024,
+					},
+					{
+						Title: "No enclosure",
+					},
+				},
+			},
+		},
+		{
+			name: "Atom",
+			in: `<feed xmlns="http://www.w3.org/2005/Atom">
+	<title>Podcast</title>
+	<subtitle>About things</subtitle>
+	<logo>http://example.com/logo.png</logo>
+	<entry>
+		<id>urn:1</id>
+		<title>Episode 1</title>
+		<summary>First</summary>
+		<updated>2006-01-02T15:04:05Z</updated>
+		<link rel="alternate" href="http://example.com/1"/>
+		<link rel="enclosure" href="http://example.com/1.ogg" type="audio/ogg" length="2048"/>
+	</entry>
+</feed>`,
+			f: feed{
+				Title:       "Podcast",
+				Description: "About things",
+				ImageURL:    "http://example.com/logo.png",
+				Items: []feedItem{
+					{
+						GUID:        "urn:1",
+						Title:       "Episode 1",
+						Description: "First",
+						Published:   time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+						URL:         "http://example.com/1.ogg",
+						ContentType: "audio/ogg",
+						Size:        2048,
+					},
+				},
+			},
+		},
+		{
+			name: "unknown",
+			in:   `<html><body>not a feed</body></html>`,
+			err:  errUnknownFeed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := parseFeed(strings.NewReader(tt.in))
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("unexpected error:\n- want: %v\n-  got: %v", want, got)
+			}
+
+			// Compare times separately, as their locations may differ
+			for i := range f.Items {
+				if i < len(tt.f.Items) && f.Items[i].Published.Equal(tt.f.Items[i].Published) {
+					f.Items[i].Published = tt.f.Items[i].Published
+				}
+			}
+
+			if want, got := tt.f, f; !reflect.DeepEqual(want, got) {
+				t.Fatalf("unexpected feed:\n- want: %+v\n-  got: %+v", want, got)
+			}
+		})
+	}
+}
@@ -35,6 +35,17 @@ func indexFiles(files []string) []indexedFile {
 
 	var out []indexedFile
 	for _, f := range files {
+		// Remote URIs are not part of the directory hierarchy
+		if isRemoteURI(f) {
+			out = append(out, indexedFile{
+				ID:   idx,
+				Name: f,
+				Dir:  false,
+			})
+			idx++
+			continue
+		}
+
 		// Track directories encountered using a stack
 		var dirs stack
 
@@ -74,6 +85,47 @@ func indexFiles(files []string) []indexedFile {
 	return out
 }
 
+// visibleFiles filters an input slice of indexedFiles and produces an output
+// slice containing only the items which u may access.  IDs are preserved.
+func visibleFiles(u *User, files []indexedFile) []indexedFile {
+	if len(u.Directories) == 0 {
+		return files
+	}
+
+	out := make([]indexedFile, 0, len(files))
+	for _, f := range files {
+		if u.allowed(f.Name) {
+			out = append(out, f)
+		}
+	}
+
+	return out
+}
+
+// lookupFile returns the indexedFile with the specified ID from an input
+// slice produced by indexFiles, if it exists and u may access it.
+func lookupFile(u *User, files []indexedFile, id int) (indexedFile, bool) {
+	if id < 0 || id >= len(files) || !u.allowed(files[id].Name) {
+		return indexedFile{}, false
+	}
+
+	return files[id], true
+}
+
+// findFile returns the file with the specified name from an input slice
+// produced by indexFiles, if it exists and u may access it.  Files are found
+// by name so that state which outlives an index, such as a bookmark, can
+// locate its file again.
+func findFile(u *User, files []indexedFile, name string) (indexedFile, bool) {
+	for _, f := range files {
+		if f.Name == name && !f.Dir {
+			return f, u.allowed(f.Name)
+		}
+	}
+
+	return indexedFile{}, false
+}
+
 // filterFiles filters an input slice of indexedFiles and produces a
 // filtered output slice containing all of the items which belong in a given
 // directory, specified using its index in start.
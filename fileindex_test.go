@@ -27,6 +27,28 @@ func Test_indexFiles(t *testing.T) {
 				Dir:  false,
 			}},
 		},
+		{
+			name: "remote URI",
+			files: []string{
+				"bar/bar.mp3",
+				"http://example.com/radio/stream.mp3",
+			},
+			out: []indexedFile{
+				{
+					ID:   0,
+					Name: "bar",
+					Dir:  true,
+				},
+				{
+					ID:   1,
+					Name: "bar/bar.mp3",
+				},
+				{
+					ID:   2,
+					Name: "http://example.com/radio/stream.mp3",
+				},
+			},
+		},
 		{
 			name: "three files",
 			files: []string{
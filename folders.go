@@ -0,0 +1,143 @@
+package mpdsub
+
+import (
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+// A Folder is an additional MPD server and music directory pair, which is
+// exposed to Subsonic clients as a separate music folder.
+type Folder struct {
+	// Name specifies the name of the music folder displayed to Subsonic
+	// clients.  If Name is empty, the base name of MusicDirectory is used.
+	Name string
+
+	// Client is the MPD client used to query this folder's database.
+	Client *mpd.Client
+
+	// MusicDirectory specifies the root music directory for the MPD server
+	// used by Client, as with Config.MusicDirectory.
+	MusicDirectory string
+
+	// Mounts specifies storage mounts for the MPD server used by Client,
+	// as with Config.Mounts.
+	Mounts map[string]string
+}
+
+// A folder is a backing MPD database and music directory which is exposed
+// to Subsonic clients as a music folder.
+type folder struct {
+	ID     int
+	Name   string
+	Dir    string
+	Mounts map[string]string
+
+	db database
+}
+
+// newFolder creates a folder with the input ID, name, database, and music
+// directory.  If name is empty, it is derived from dir.
+func newFolder(id int, name string, db database, dir string) *folder {
+	if name == "" {
+		name = filepath.Base(dir)
+	}
+
+	return &folder{
+		ID:   id,
+		Name: name,
+		Dir:  dir,
+		db:   db,
+	}
+}
+
+// index lists all files in the folder's database and indexes them using
+// indexFiles.
+func (f *folder) index() ([]indexedFile, error) {
+	fs, err := f.db.List("file")
+	if err != nil {
+		return nil, err
+	}
+
+	return indexFiles(fs), nil
+}
+
+// duration returns the duration of the file with the input name, as reported
+// by the folder's database.
+func (f *folder) duration(name string) (time.Duration, error) {
+	infos, err := f.db.ListAllInfo(name)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, info := range infos {
+		if info["file"] != name {
+			continue
+		}
+
+		// Prefer the more precise duration attribute, but fall back to the
+		// older whole seconds attribute if needed
+		if d, err := strconv.ParseFloat(info["duration"], 64); err == nil {
+			return time.Duration(d * float64(time.Second)), nil
+		}
+		if d, err := strconv.Atoi(info["Time"]); err == nil {
+			return time.Duration(d) * time.Second, nil
+		}
+	}
+
+	return 0, errors.New("no duration available for file: " + name)
+}
+
+// errInvalidID is returned when an item ID cannot be parsed.
+var errInvalidID = errors.New("invalid item ID")
+
+// formatID formats the ID of an indexedFile within the folder with ID folder,
+// so that the folder can be recovered using parseID.  IDs of items in the
+// first folder are plain integers, for compatibility with clients which have
+// cached IDs from a single folder Server.
+func formatID(folder, id int) string {
+	if folder == 0 {
+		return strconv.Itoa(id)
+	}
+
+	return strconv.Itoa(folder) + "-" + strconv.Itoa(id)
+}
+
+// parseID parses an item ID produced by formatID into its folder and
+// indexedFile IDs.
+func parseID(s string) (folder int, id int, err error) {
+	ss := strings.SplitN(s, "-", 2)
+	if len(ss) == 1 {
+		id, err := strconv.Atoi(ss[0])
+		if err != nil {
+			return 0, 0, errInvalidID
+		}
+
+		return 0, id, nil
+	}
+
+	folder, err = strconv.Atoi(ss[0])
+	if err != nil || folder < 0 {
+		return 0, 0, errInvalidID
+	}
+
+	id, err = strconv.Atoi(ss[1])
+	if err != nil {
+		return 0, 0, errInvalidID
+	}
+
+	return folder, id, nil
+}
+
+// lookupFolder returns the folder with the input ID, if it exists.
+func (s *Server) lookupFolder(id int) (*folder, bool) {
+	if id < 0 || id >= len(s.folders) {
+		return nil, false
+	}
+
+	return s.folders[id], true
+}
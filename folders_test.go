@@ -0,0 +1,75 @@
+package mpdsub
+
+import (
+	"testing"
+)
+
+func Test_parseID(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      string
+		folder int
+		id     int
+		ok     bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "bad integer",
+			s:    "foo",
+		},
+		{
+			name: "bad folder",
+			s:    "foo-1",
+		},
+		{
+			name: "negative folder",
+			s:    "-1",
+		},
+		{
+			name: "bad file",
+			s:    "1-foo",
+		},
+		{
+			name: "first folder",
+			s:    "10",
+			id:   10,
+			ok:   true,
+		},
+		{
+			name:   "second folder",
+			s:      "1-10",
+			folder: 1,
+			id:     10,
+			ok:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			folder, id, err := parseID(tt.s)
+			if err != nil {
+				if tt.ok {
+					t.Fatalf("unexpected error: %v", err)
+				}
+
+				return
+			}
+			if !tt.ok {
+				t.Fatal("expected an error, but none occurred")
+			}
+
+			if want, got := tt.folder, folder; want != got {
+				t.Fatalf("unexpected folder ID:\n- want: %v\n-  got: %v", want, got)
+			}
+			if want, got := tt.id, id; want != got {
+				t.Fatalf("unexpected file ID:\n- want: %v\n-  got: %v", want, got)
+			}
+
+			if want, got := tt.s, formatID(folder, id); want != got {
+				t.Fatalf("unexpected formatted ID:\n- want: %q\n-  got: %q", want, got)
+			}
+		})
+	}
+}
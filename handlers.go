@@ -1,10 +1,13 @@
 package mpdsub
 
 import (
-	"log"
+	"archive/zip"
+	"io"
+	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -22,15 +25,53 @@ func (s *Server) getLicense(w http.ResponseWriter, r *http.Request) {
 }
 
 // getIndexes returns a set of top-level indexes that indicate the top-level
-// items and directories.
+// items and directories.  If the musicFolderId parameter is set, only items
+// from that music folder are returned.
 func (s *Server) getIndexes(w http.ResponseWriter, r *http.Request) {
-	fs, err := s.db.List("file")
-	if err != nil {
-		s.logf("error listing files from mpd for building indexes: %v", err)
-		writeXML(w, errGeneric)
-		return
+	folders := s.folders
+	if qID := r.Form.Get("musicFolderId"); qID != "" {
+		id, err := strconv.Atoi(qID)
+		if err != nil {
+			writeXML(w, errNotFound)
+			return
+		}
+
+		f, ok := s.lookupFolder(id)
+		if !ok {
+			writeXML(w, errNotFound)
+			return
+		}
+
+		folders = []*folder{f}
 	}
-	files := indexFiles(fs)
+
+	// Gather top-level items from each folder, so they can be sorted into
+	// a single set of indexes
+	var artists []artist
+	for _, f := range folders {
+		files, err := f.index()
+		if err != nil {
+			s.logf("error listing files from mpd for building indexes: %v", err)
+			writeXML(w, errGeneric)
+			return
+		}
+
+		for _, ff := range visibleFiles(requestUser(r), files) {
+			// Filter any non-top level items
+			if strings.Contains(ff.Name, string(os.PathSeparator)) {
+				continue
+			}
+
+			artists = append(artists, artist{
+				Name: ff.Name,
+				ID:   formatID(f.ID, ff.ID),
+			})
+		}
+	}
+
+	sort.SliceStable(artists, func(i, j int) bool {
+		return artists[i].Name < artists[j].Name
+	})
 
 	writeXML(w, func(c *container) {
 		c.Indexes = &indexesContainer{
@@ -47,14 +88,9 @@ func (s *Server) getIndexes(w http.ResponseWriter, r *http.Request) {
 		// nwe indexes
 		seenChars := make(map[rune]struct{}, 0)
 
-		for _, f := range files {
-			// Filter any non-top level items
-			if strings.Contains(f.Name, string(os.PathSeparator)) {
-				continue
-			}
-
+		for _, a := range artists {
 			// Initial rune is used to create an index name
-			c, _ := utf8.DecodeRuneInString(f.Name)
+			c, _ := utf8.DecodeRuneInString(a.Name)
 			name := string(c)
 
 			// If initial rune is a digit, put index under a numeric section
@@ -70,10 +106,7 @@ func (s *Server) getIndexes(w http.ResponseWriter, r *http.Request) {
 				idx++
 			}
 
-			indexes[idx].Artists = append(indexes[idx].Artists, artist{
-				Name: f.Name,
-				ID:   strconv.Itoa(f.ID),
-			})
+			indexes[idx].Artists = append(indexes[idx].Artists, a)
 		}
 
 		c.Indexes.Indexes = indexes
@@ -82,28 +115,19 @@ func (s *Server) getIndexes(w http.ResponseWriter, r *http.Request) {
 
 // getMusicDirectory returns the contents of a single music directory.
 func (s *Server) getMusicDirectory(w http.ResponseWriter, r *http.Request) {
-	qID := r.URL.Query().Get("id")
+	qID := r.Form.Get("id")
 	if qID == "" {
 		writeXML(w, errMissingParameter)
 		return
 	}
 
-	id, err := strconv.Atoi(qID)
-	if err != nil {
-		writeXML(w, errGeneric)
+	folder, all, dir, ok := s.lookupItem(w, r, qID)
+	if !ok {
 		return
 	}
 
-	fs, err := s.db.List("file")
+	files, err := tagFiles(folder.db, filterFiles(all, dir.ID))
 	if err != nil {
-		s.logf("error listing files from mpd for getting music directory: %v", err)
-		writeXML(w, errGeneric)
-		return
-	}
-
-	files, err := tagFiles(s.db, filterFiles(indexFiles(fs), id))
-	if err != nil {
-		log.Println(err)
 		s.logf("error tagging files from mpd for getting music directory: %v", err)
 		writeXML(w, errGeneric)
 		return
@@ -111,40 +135,66 @@ func (s *Server) getMusicDirectory(w http.ResponseWriter, r *http.Request) {
 
 	// No files matching criteria
 	if len(files) == 0 {
-		http.NotFound(w, r)
+		writeXML(w, errNotFound)
 		return
 	}
 
 	var children []child
 	for _, f := range files {
-		ext := strings.TrimPrefix(filepath.Ext(f.Name), ".")
-		children = append(children, child{
-			ID:     strconv.Itoa(f.ID),
-			Album:  f.Album,
-			Artist: f.Artist,
-			IsDir:  f.Dir,
-			Suffix: ext,
-			Title:  f.Title,
-		})
+		children = append(children, newChild(folder, f))
 	}
 
 	writeXML(w, func(c *container) {
 		c.MusicDirectory = &musicDirectoryContainer{
-			ID:       strconv.Itoa(id),
+			ID:       formatID(folder.ID, dir.ID),
 			Name:     files[0].Name,
 			Children: children,
 		}
 	})
 }
 
-// getMusicFolders returns the location of MPD's music directory.
+// newChild creates a child for a tagged file in folder.
+func newChild(folder *folder, f metadataFile) child {
+	return child{
+		ID:     formatID(folder.ID, f.ID),
+		Album:  f.Album,
+		Artist: f.Artist,
+		IsDir:  f.Dir,
+		Suffix: strings.TrimPrefix(filepath.Ext(f.Name), "."),
+		Title:  f.Title,
+	}
+}
+
+// getMusicFolders returns the location of each MPD server's music directory.
 func (s *Server) getMusicFolders(w http.ResponseWriter, r *http.Request) {
+	u := requestUser(r)
+
+	var folders []musicFolder
+	for _, f := range s.folders {
+		// Hide music folders from users who cannot access any of their
+		// contents
+		if len(u.Directories) > 0 {
+			files, err := f.index()
+			if err != nil {
+				s.logf("error listing files from mpd for getting music folders: %v", err)
+				writeXML(w, errGeneric)
+				return
+			}
+
+			if len(visibleFiles(u, files)) == 0 {
+				continue
+			}
+		}
+
+		folders = append(folders, musicFolder{
+			ID:   f.ID,
+			Name: f.Name,
+		})
+	}
+
 	writeXML(w, func(c *container) {
 		c.MusicFolders = &musicFoldersContainer{
-			MusicFolders: []musicFolder{{
-				ID:   0,
-				Name: filepath.Base(s.cfg.MusicDirectory),
-			}},
+			MusicFolders: folders,
 		}
 	})
 }
@@ -154,52 +204,257 @@ func (s *Server) ping(w http.ResponseWriter, r *http.Request) {
 	writeXML(w, nil)
 }
 
-// stream opens a file for streaming, and serves it to a client.
+// notFound returns an error for any unknown API route.
+func (s *Server) notFound(w http.ResponseWriter, r *http.Request) {
+	writeXML(w, errNotFound)
+}
+
+// stream opens a file for streaming, and serves it to a client.  If a
+// Transcoder is configured, the file is transcoded when required to satisfy
+// the format, maxBitRate, and timeOffset parameters, and its length may be
+// estimated using the estimateContentLength parameter.
 func (s *Server) stream(w http.ResponseWriter, r *http.Request) {
-	qID := r.URL.Query().Get("id")
+	q := r.Form
+
+	qID := q.Get("id")
 	if qID == "" {
 		writeXML(w, errMissingParameter)
 		return
 	}
 
-	id, err := strconv.Atoi(qID)
+	var maxBitRate int
+	if qBitRate := q.Get("maxBitRate"); qBitRate != "" {
+		var err error
+		maxBitRate, err = strconv.Atoi(qBitRate)
+		if err != nil {
+			writeXML(w, errGeneric)
+			return
+		}
+	}
+
+	// Clients seek within transcoded streams by requesting a new stream
+	// which begins at an offset in seconds
+	offset, err := parseSeconds(q.Get("timeOffset"))
 	if err != nil {
 		writeXML(w, errGeneric)
 		return
 	}
 
-	fs, err := s.db.List("file")
+	folder, _, file, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return
+	}
+
+	// Files which are not stored in the music directory are proxied from
+	// their upstream server as-is
+	if u, ok := folder.remoteURL(file.Name); ok {
+		s.proxy(w, r, u)
+		return
+	}
+
+	p := filepath.Join(folder.Dir, file.Name)
+
+	f, ok := s.openFile(w, r, folder, file.Name)
+	if !ok {
+		return
+	}
+	defer f.Close()
+
+	ext := strings.TrimPrefix(filepath.Ext(p), ".")
+	if opts, ok := transcodeOptions(s.cfg.Transcoder, ext, q.Get("format"), maxBitRate, offset, s.cfg.TranscodeFormat, s.cfg.TranscodeBitRate); ok {
+		// Some clients require a Content-Length, so an estimate can be
+		// computed from the duration of the remainder of the file
+		var length int64
+		if q.Get("estimateContentLength") == "true" {
+			d, err := folder.duration(file.Name)
+			if err != nil {
+				s.logf("error retrieving duration to estimate content length: %v", err)
+			}
+
+			length = estimateLength(d-offset, opts.BitRate)
+		}
+
+		s.transcode(w, r, f, opts, length)
+		return
+	}
+
+	stat, err := f.Stat()
 	if err != nil {
-		s.logf("error listing files from mpd for streaming: %v", err)
+		s.logf("error stat'ing file for streaming: %q", p)
 		writeXML(w, errGeneric)
 		return
 	}
-	files := indexFiles(fs)
 
-	// Don't allow out of bounds slice access
-	if id >= len(files) {
-		http.NotFound(w, r)
+	http.ServeContent(w, r, p, stat.ModTime(), f)
+}
+
+// download serves an untranscoded file to a client as an attachment.  If the
+// ID refers to a directory, a zip archive of all files beneath it is streamed
+// to the client instead.
+func (s *Server) download(w http.ResponseWriter, r *http.Request) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	folder, files, file, ok := s.lookupItem(w, r, qID)
+	if !ok {
 		return
 	}
 
-	p := filepath.Join(s.cfg.MusicDirectory, files[id].Name)
+	if file.Dir {
+		s.downloadZip(w, folder, files, file)
+		return
+	}
 
-	f, err := s.fs.Open(p)
+	// Files which are not stored in the music directory are proxied from
+	// their upstream server as-is
+	if u, ok := folder.remoteURL(file.Name); ok {
+		w.Header().Set("Content-Disposition", attachment(remoteName(u)))
+		s.proxy(w, r, u)
+		return
+	}
+
+	p := filepath.Join(folder.Dir, file.Name)
+
+	f, ok := s.openFile(w, r, folder, file.Name)
+	if !ok {
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
 	if err != nil {
-		s.logf("error opening file for streaming: %q", p)
+		s.logf("error stat'ing file for download: %q", p)
 		writeXML(w, errGeneric)
 		return
 	}
+
+	w.Header().Set("Content-Disposition", attachment(filepath.Base(file.Name)))
+	http.ServeContent(w, r, p, stat.ModTime(), f)
+}
+
+// downloadZip streams a zip archive containing all files beneath dir to a
+// client.  Files are read and written one at a time, so the archive is never
+// buffered in memory or on disk.  Files which are not stored in the music
+// directory are omitted.
+func (s *Server) downloadZip(w http.ResponseWriter, folder *folder, files []indexedFile, dir indexedFile) {
+	w.Header().Set(contentType, "application/zip")
+	w.Header().Set("Content-Disposition", attachment(filepath.Base(dir.Name)+".zip"))
+
+	// Name files relative to the directory's parent, so the archive
+	// extracts into a single directory
+	parent := filepath.Dir(dir.Name)
+	prefix := dir.Name + string(os.PathSeparator)
+
+	zw := zip.NewWriter(w)
+	for _, f := range files {
+		if f.Dir || !strings.HasPrefix(f.Name, prefix) {
+			continue
+		}
+
+		if _, ok := folder.remoteURL(f.Name); ok {
+			if s.cfg.Verbose {
+				s.logf("omitting remote file %q from zip for download", f.Name)
+			}
+			continue
+		}
+
+		name, err := filepath.Rel(parent, f.Name)
+		if err != nil {
+			s.logf("error creating zip path for %q: %v", f.Name, err)
+			return
+		}
+
+		err = s.zipFile(zw, folder, f.Name, filepath.ToSlash(name))
+		switch err {
+		case nil:
+		case errPathEscapes, errPathSymlink:
+			// Omit files which the symbolic link policy forbids
+			if s.cfg.Verbose {
+				s.logf("omitting %q from zip for download: %v", f.Name, err)
+			}
+		default:
+			// Response is already partially written, so the best we can do
+			// is to stop and let the client notice a truncated archive
+			s.logf("error writing %q to zip for download: %v", f.Name, err)
+			return
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		s.logf("error finishing zip for download: %v", err)
+	}
+}
+
+// zipFile copies the file with the input name in folder into zw as an entry
+// with the input zip name.
+func (s *Server) zipFile(zw *zip.Writer, folder *folder, name string, zipName string) error {
+	p, err := resolvePath(s.fs, folder.Dir, name, s.cfg.Symlinks)
+	if err != nil {
+		return err
+	}
+
+	f, err := s.fs.Open(p)
+	if err != nil {
+		return err
+	}
 	defer f.Close()
 
 	stat, err := f.Stat()
 	if err != nil {
-		s.logf("error stat'ing file for streaming: %q", p)
+		return err
+	}
+
+	// Media files are already compressed, so store them as-is
+	fw, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     zipName,
+		Method:   zip.Store,
+		Modified: stat.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(fw, f)
+	return err
+}
+
+// attachment produces a Content-Disposition header value which instructs a
+// client to save a response as a file with the input name.
+func attachment(name string) string {
+	return mime.FormatMediaType("attachment", map[string]string{
+		"filename": name,
+	})
+}
+
+// transcode transcodes media read from f using the Server's Transcoder, and
+// streams the result to a client.  If length is greater than 0, exactly
+// length bytes are streamed, and Content-Length is set accordingly.
+func (s *Server) transcode(w http.ResponseWriter, r *http.Request, f io.Reader, opts TranscodeOptions, length int64) {
+	rc, err := s.cfg.Transcoder.Transcode(r.Context(), f, opts)
+	if err != nil {
+		s.logf("error transcoding file for streaming: %v", err)
 		writeXML(w, errGeneric)
 		return
 	}
+	defer rc.Close()
 
-	http.ServeContent(w, r, p, stat.ModTime(), f)
+	// Transcoded media is produced on the fly, so byte ranges cannot be
+	// served
+	w.Header().Set(contentType, formatContentType(opts.Format))
+	w.Header().Set("Accept-Ranges", "none")
+
+	var out io.Reader = rc
+	if length > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+		out = &paddedReader{R: rc, N: length}
+	}
+
+	if _, err := io.Copy(w, out); err != nil && s.cfg.Verbose {
+		s.logf("error copying transcoded stream: %v", err)
+	}
 }
 
 // A stack is a stack data structure for strings.
@@ -221,3 +476,93 @@ func (s *stack) Pop() string {
 	*s = (*s)[:len(*s)-1]
 	return str
 }
+
+// lookupItem parses an item ID and returns the folder containing the item,
+// the folder's indexed files, and the item itself.  If the item does not
+// exist or the user cannot access it, an error is written to w and lookupItem
+// returns false.
+func (s *Server) lookupItem(w http.ResponseWriter, r *http.Request, qID string) (*folder, []indexedFile, indexedFile, bool) {
+	fid, id, err := parseID(qID)
+	if err != nil {
+		writeXML(w, errNotFound)
+		return nil, nil, indexedFile{}, false
+	}
+
+	folder, ok := s.lookupFolder(fid)
+	if !ok {
+		writeXML(w, errNotFound)
+		return nil, nil, indexedFile{}, false
+	}
+
+	files, err := folder.index()
+	if err != nil {
+		s.logf("error listing files from mpd for looking up item: %v", err)
+		writeXML(w, errGeneric)
+		return nil, nil, indexedFile{}, false
+	}
+
+	// Don't allow out of bounds slice access or access to files the user
+	// cannot see
+	file, ok := lookupFile(requestUser(r), files, id)
+	if !ok {
+		writeXML(w, errNotFound)
+		return nil, nil, indexedFile{}, false
+	}
+
+	return folder, files, file, true
+}
+
+// openFile resolves the path of the file with the input name in folder and
+// opens it.  If the path is rejected or the file cannot be opened, an error is
+// written to w and openFile returns false.
+func (s *Server) openFile(w http.ResponseWriter, r *http.Request, folder *folder, name string) (file, bool) {
+	p, err := resolvePath(s.fs, folder.Dir, name, s.cfg.Symlinks)
+	if err == nil {
+		var f file
+		f, err = s.fs.Open(p)
+		if err == nil {
+			return f, true
+		}
+	}
+
+	switch {
+	case err == errPathEscapes || err == errPathSymlink:
+		if s.cfg.Verbose {
+			s.logf("rejected path for %q: %v", name, err)
+		}
+		writeXML(w, errNotAuthorized)
+	case os.IsNotExist(err):
+		writeXML(w, errNotFound)
+	default:
+		s.logf("error opening file %q: %v", name, err)
+		writeXML(w, errGeneric)
+	}
+
+	return nil, false
+}
+
+// openSidecar opens the sidecar file with the input name in folder, such as
+// lyrics or artist information stored beside music files.  It returns false
+// if the file is remote, does not exist, or may not be opened under the
+// Server's symbolic link policy.
+func (s *Server) openSidecar(folder *folder, name string) (file, bool, error) {
+	if _, ok := folder.remoteURL(name); ok {
+		return nil, false, nil
+	}
+
+	p, err := resolvePath(s.fs, folder.Dir, name, s.cfg.Symlinks)
+	if err == nil {
+		var f file
+		f, err = s.fs.Open(p)
+		if err == nil {
+			return f, true, nil
+		}
+	}
+
+	switch {
+	case err == errPathEscapes || err == errPathSymlink, os.IsNotExist(err):
+		return nil, false, nil
+	default:
+		return nil, false, err
+	}
+}
@@ -1,7 +1,9 @@
 package mpdsub
 
 import (
-	"encoding/xml"
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
 	"net/http"
 	"path/filepath"
 	"reflect"
@@ -201,14 +203,14 @@ func TestServer_getMusicDirectory(t *testing.T) {
 
 			id: "foo",
 
-			xmlError: &subsonicError{Code: codeGeneric},
+			xmlError: &subsonicError{Code: codeNotFound},
 		},
 		{
 			name: "no files",
 
 			id: "0",
 
-			httpCode: http.StatusNotFound,
+			xmlError: &subsonicError{Code: codeNotFound},
 		},
 		{
 			name: "one file",
@@ -362,14 +364,14 @@ func TestServer_stream(t *testing.T) {
 
 			id: "foo",
 
-			xmlError: &subsonicError{Code: codeGeneric},
+			xmlError: &subsonicError{Code: codeNotFound},
 		},
 		{
 			name: "no files",
 
 			id: "0",
 
-			httpCode: http.StatusNotFound,
+			xmlError: &subsonicError{Code: codeNotFound},
 		},
 		{
 			name: "one MP3",
@@ -418,6 +420,33 @@ func TestServer_stream(t *testing.T) {
 			contentType:   audioFLAC,
 			contentLength: 4,
 		},
+		{
+			name: "path escapes music directory",
+			db: &memoryDatabase{
+				files: []string{"../etc/passwd"},
+			},
+			fs: &memoryFilesystem{
+				files: map[string]*memoryFile{
+					"/var/etc/passwd": &memoryFile{
+						ReadSeeker: strings.NewReader(`root`),
+					},
+				},
+			},
+
+			id: "2",
+
+			xmlError: &subsonicError{Code: codeNotAuthorized},
+		},
+		{
+			name: "file missing from music directory",
+			db: &memoryDatabase{
+				files: []string{"foo.mp3"},
+			},
+
+			id: "0",
+
+			xmlError: &subsonicError{Code: codeNotFound},
+		},
 	}
 
 	for _, tt := range tests {
@@ -465,6 +494,649 @@ func TestServer_stream(t *testing.T) {
 	}
 }
 
+func TestServer_streamTranscode(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	tests := []struct {
+		name       string
+		transcoder Transcoder
+		format     string
+		maxBitRate string
+		timeOffset string
+		estimate   bool
+		duration   string
+
+		xmlError    *subsonicError
+		contentType string
+		body        string
+	}{
+		{
+			name:        "no transcoder",
+			format:      "mp3",
+			contentType: "audio/flac",
+			body:        "flac",
+		},
+		{
+			name:        "no format",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			contentType: "audio/flac",
+			body:        "flac",
+		},
+		{
+			name:        "raw format",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			format:      "raw",
+			contentType: "audio/flac",
+			body:        "flac",
+		},
+		{
+			name:        "unsupported format",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			format:      "opus",
+			contentType: "audio/flac",
+			body:        "flac",
+		},
+		{
+			name:        "same format",
+			transcoder:  &memoryTranscoder{formats: []string{"flac"}},
+			format:      "flac",
+			contentType: "audio/flac",
+			body:        "flac",
+		},
+		{
+			name:       "bad bitrate",
+			transcoder: &memoryTranscoder{formats: []string{"mp3"}},
+			maxBitRate: "foo",
+			xmlError:   &subsonicError{Code: codeGeneric},
+		},
+		{
+			name:        "format",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			format:      "mp3",
+			contentType: "audio/mpeg",
+			body:        "mp3:0:0:flac",
+		},
+		{
+			name:        "format and bitrate",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			format:      "mp3",
+			maxBitRate:  "128",
+			contentType: "audio/mpeg",
+			body:        "mp3:128:0:flac",
+		},
+		{
+			name:        "bitrate, default format",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			maxBitRate:  "96",
+			contentType: "audio/mpeg",
+			body:        "mp3:96:0:flac",
+		},
+		{
+			name:       "bad time offset",
+			transcoder: &memoryTranscoder{formats: []string{"mp3"}},
+			timeOffset: "-1",
+			xmlError:   &subsonicError{Code: codeGeneric},
+		},
+		{
+			name:        "time offset, no transcoder",
+			timeOffset:  "30",
+			contentType: "audio/flac",
+			body:        "flac",
+		},
+		{
+			name:        "time offset, default format",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			timeOffset:  "30",
+			contentType: "audio/mpeg",
+			body:        "mp3:0:30:flac",
+		},
+		{
+			name:        "time offset, same format",
+			transcoder:  &memoryTranscoder{formats: []string{"flac"}},
+			format:      "flac",
+			timeOffset:  "1.5",
+			contentType: "audio/flac",
+			body:        "flac:0:1.5:flac",
+		},
+		{
+			name:        "estimate length, truncated",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			format:      "mp3",
+			maxBitRate:  "8",
+			estimate:    true,
+			duration:    "0.008",
+			contentType: "audio/mpeg",
+			body:        "mp3:8:0:",
+		},
+		{
+			name:        "estimate length, padded",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			format:      "mp3",
+			maxBitRate:  "8",
+			estimate:    true,
+			duration:    "0.016",
+			contentType: "audio/mpeg",
+			body:        "mp3:8:0:flac\x00\x00\x00\x00",
+		},
+		{
+			name:        "estimate length, unknown duration",
+			transcoder:  &memoryTranscoder{formats: []string{"mp3"}},
+			format:      "mp3",
+			maxBitRate:  "8",
+			estimate:    true,
+			contentType: "audio/mpeg",
+			body:        "mp3:8:0:flac",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &memoryDatabase{
+				files: []string{"foo.flac"},
+			}
+			if tt.duration != "" {
+				db.info = map[string]mpd.Attrs{
+					"foo.flac": {
+						"file":     "foo.flac",
+						"duration": tt.duration,
+					},
+				}
+			}
+
+			fs := &memoryFilesystem{
+				files: map[string]*memoryFile{
+					filepath.Join(musicDirectory, "foo.flac"): &memoryFile{
+						ReadSeeker: strings.NewReader(`flac`),
+					},
+				},
+			}
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = musicDirectory
+			cfg.Transcoder = tt.transcoder
+			cfg.TranscodeFormat = "mp3"
+
+			values.Set("id", "0")
+			if tt.format != "" {
+				values.Set("format", tt.format)
+			}
+			if tt.maxBitRate != "" {
+				values.Set("maxBitRate", tt.maxBitRate)
+			}
+			if tt.timeOffset != "" {
+				values.Set("timeOffset", tt.timeOffset)
+			}
+			if tt.estimate {
+				values.Set("estimateContentLength", "true")
+			}
+
+			withServer(t, db, fs, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, "/rest/stream.view", values)
+
+				if tt.xmlError != nil {
+					c := mustDecodeXML(t, res)
+					if want, got := tt.xmlError.Code, c.Error.Code; want != got {
+						t.Fatalf("unexpected XML error code::\n- want: %v\n-  got: %v",
+							want, got)
+					}
+
+					return
+				}
+
+				if want, got := tt.contentType, res.Header.Get(contentType); want != got {
+					t.Fatalf("unexpected Content-Type header:\n- want: %q\n-  got: %q",
+						want, got)
+				}
+
+				b, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatalf("failed to read body: %v", err)
+				}
+				_ = res.Body.Close()
+
+				if want, got := tt.body, string(b); want != got {
+					t.Fatalf("unexpected body:\n- want: %q\n-  got: %q",
+						want, got)
+				}
+
+				if tt.duration != "" {
+					if want, got := int64(len(tt.body)), res.ContentLength; want != got {
+						t.Fatalf("unexpected Content-Length:\n- want: %v\n-  got: %v",
+							want, got)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestServer_download(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	tests := []struct {
+		name string
+		id   string
+
+		xmlError    *subsonicError
+		httpCode    int
+		disposition string
+		body        string
+		zip         map[string]string
+	}{
+		{
+			name:     "no ID",
+			xmlError: &subsonicError{Code: codeMissingParameter},
+		},
+		{
+			name:     "not found",
+			id:       "10",
+			xmlError: &subsonicError{Code: codeNotFound},
+		},
+		{
+			name:        "file",
+			id:          "2",
+			disposition: `attachment; filename=01.flac`,
+			body:        "one",
+		},
+		{
+			name:        "directory",
+			id:          "1",
+			disposition: `attachment; filename=Album.zip`,
+			zip: map[string]string{
+				"Album/01.flac":     "one",
+				"Album/02.flac":     "two",
+				"Album/CD2/01.flac": "three",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &memoryDatabase{
+				files: []string{
+					"Artist/Album/01.flac",
+					"Artist/Album/02.flac",
+					"Artist/Album/CD2/01.flac",
+					"Artist/Other/01.flac",
+				},
+			}
+
+			fs := &memoryFilesystem{
+				files: map[string]*memoryFile{
+					filepath.Join(musicDirectory, "Artist/Album/01.flac"): &memoryFile{
+						ReadSeeker: strings.NewReader(`one`),
+					},
+					filepath.Join(musicDirectory, "Artist/Album/02.flac"): &memoryFile{
+						ReadSeeker: strings.NewReader(`two`),
+					},
+					filepath.Join(musicDirectory, "Artist/Album/CD2/01.flac"): &memoryFile{
+						ReadSeeker: strings.NewReader(`three`),
+					},
+					filepath.Join(musicDirectory, "Artist/Other/01.flac"): &memoryFile{
+						ReadSeeker: strings.NewReader(`other`),
+					},
+				},
+			}
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = musicDirectory
+
+			if tt.id != "" {
+				values.Set("id", tt.id)
+			}
+
+			withServer(t, db, fs, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, "/rest/download.view", values)
+
+				if tt.xmlError != nil {
+					c := mustDecodeXML(t, res)
+					if want, got := tt.xmlError.Code, c.Error.Code; want != got {
+						t.Fatalf("unexpected XML error code::\n- want: %v\n-  got: %v",
+							want, got)
+					}
+
+					return
+				}
+
+				if tt.httpCode != 0 {
+					if want, got := tt.httpCode, res.StatusCode; want != got {
+						t.Fatalf("unexpected HTTP status code:\n- want: %03d\n-  got: %03d",
+							want, got)
+					}
+
+					return
+				}
+
+				if want, got := tt.disposition, res.Header.Get("Content-Disposition"); want != got {
+					t.Fatalf("unexpected Content-Disposition header:\n- want: %q\n-  got: %q",
+						want, got)
+				}
+
+				b, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatalf("failed to read body: %v", err)
+				}
+				_ = res.Body.Close()
+
+				if tt.zip == nil {
+					if want, got := tt.body, string(b); want != got {
+						t.Fatalf("unexpected body:\n- want: %q\n-  got: %q",
+							want, got)
+					}
+
+					return
+				}
+
+				zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+				if err != nil {
+					t.Fatalf("failed to open zip: %v", err)
+				}
+
+				files := make(map[string]string, len(zr.File))
+				for _, f := range zr.File {
+					rc, err := f.Open()
+					if err != nil {
+						t.Fatalf("failed to open zip file: %v", err)
+					}
+
+					fb, err := ioutil.ReadAll(rc)
+					if err != nil {
+						t.Fatalf("failed to read zip file: %v", err)
+					}
+					_ = rc.Close()
+
+					files[f.Name] = string(fb)
+				}
+
+				if want, got := tt.zip, files; !reflect.DeepEqual(want, got) {
+					t.Fatalf("unexpected zip contents:\n- want: %v\n-  got: %v",
+						want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServerUserDirectories(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	db := &memoryDatabase{
+		files: []string{
+			"Kids/song.mp3",
+			"Rock/song.mp3",
+		},
+		attrs: map[string]mpd.Attrs{
+			"Kids/song.mp3": mpd.Attrs{},
+		},
+	}
+
+	fs := &memoryFilesystem{
+		files: map[string]*memoryFile{
+			filepath.Join(musicDirectory, "Kids/song.mp3"): &memoryFile{
+				ReadSeeker: strings.NewReader(`kids`),
+			},
+			filepath.Join(musicDirectory, "Rock/song.mp3"): &memoryFile{
+				ReadSeeker: strings.NewReader(`rock`),
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		dirs   []string
+		target string
+		id     string
+
+		xmlError *subsonicError
+		httpCode int
+		indexes  []index
+		folders  int
+	}{
+		{
+			name:   "indexes, unrestricted",
+			target: "/rest/getIndexes.view",
+			indexes: []index{
+				{
+					Name:    "K",
+					Artists: []artist{{Name: "Kids", ID: "0"}},
+				},
+				{
+					Name:    "R",
+					Artists: []artist{{Name: "Rock", ID: "2"}},
+				},
+			},
+		},
+		{
+			name:   "indexes, restricted",
+			dirs:   []string{"Kids"},
+			target: "/rest/getIndexes.view",
+			indexes: []index{{
+				Name:    "K",
+				Artists: []artist{{Name: "Kids", ID: "0"}},
+			}},
+		},
+		{
+			name:    "folders, restricted",
+			dirs:    []string{"Kids"},
+			target:  "/rest/getMusicFolders.view",
+			folders: 1,
+		},
+		{
+			name:   "folders, restricted to missing directory",
+			dirs:   []string{"Jazz"},
+			target: "/rest/getMusicFolders.view",
+		},
+		{
+			name:     "directory, restricted",
+			dirs:     []string{"Kids"},
+			target:   "/rest/getMusicDirectory.view",
+			id:       "2",
+			xmlError: &subsonicError{Code: codeNotFound},
+		},
+		{
+			name:     "directory, allowed",
+			dirs:     []string{"Kids"},
+			target:   "/rest/getMusicDirectory.view",
+			id:       "0",
+			httpCode: http.StatusOK,
+		},
+		{
+			name:     "stream, restricted",
+			dirs:     []string{"Kids"},
+			target:   "/rest/stream.view",
+			id:       "3",
+			xmlError: &subsonicError{Code: codeNotFound},
+		},
+		{
+			name:     "stream, allowed",
+			dirs:     []string{"Kids"},
+			target:   "/rest/stream.view",
+			id:       "1",
+			httpCode: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				MusicDirectory: musicDirectory,
+				Users: []User{{
+					Name:        "test",
+					Password:    "test",
+					Roles:       RoleStream,
+					Directories: tt.dirs,
+				}},
+			}
+
+			_, values := configAuth()
+			if tt.id != "" {
+				values.Set("id", tt.id)
+			}
+
+			withServer(t, db, fs, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, tt.target, values)
+
+				if tt.httpCode != 0 {
+					if want, got := tt.httpCode, res.StatusCode; want != got {
+						t.Fatalf("unexpected HTTP status code:\n- want: %03d\n-  got: %03d",
+							want, got)
+					}
+
+					return
+				}
+
+				c := mustDecodeXML(t, res)
+
+				if tt.xmlError != nil {
+					if want, got := tt.xmlError.Code, c.Error.Code; want != got {
+						t.Fatalf("unexpected XML error code:\n- want: %v\n-  got: %v",
+							want, got)
+					}
+
+					return
+				}
+
+				if tt.indexes != nil {
+					mustIndexesEqual(t, tt.indexes, c.Indexes.Indexes)
+					return
+				}
+
+				if want, got := tt.folders, len(c.MusicFolders.MusicFolders); want != got {
+					t.Fatalf("unexpected number of music folders:\n- want: %v\n-  got: %v",
+						want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServerMultipleFolders(t *testing.T) {
+	folders := []*folder{
+		newFolder(0, "", &memoryDatabase{
+			files: []string{"Music/song.mp3"},
+		}, "/var/music"),
+		newFolder(1, "Audiobooks", &memoryDatabase{
+			files: []string{"Books/book.mp3"},
+		}, "/var/audiobooks"),
+	}
+
+	fs := &memoryFilesystem{
+		files: map[string]*memoryFile{
+			"/var/audiobooks/Books/book.mp3": &memoryFile{
+				ReadSeeker: strings.NewReader(`book`),
+			},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		folder string
+		id     string
+
+		xmlError *subsonicError
+		httpCode int
+		indexes  []index
+		folders  []musicFolder
+	}{
+		{
+			name:   "indexes, all folders",
+			target: "/rest/getIndexes.view",
+			indexes: []index{
+				{
+					Name:    "B",
+					Artists: []artist{{Name: "Books", ID: "1-0"}},
+				},
+				{
+					Name:    "M",
+					Artists: []artist{{Name: "Music", ID: "0"}},
+				},
+			},
+		},
+		{
+			name:   "indexes, one folder",
+			target: "/rest/getIndexes.view",
+			folder: "1",
+			indexes: []index{{
+				Name:    "B",
+				Artists: []artist{{Name: "Books", ID: "1-0"}},
+			}},
+		},
+		{
+			name:     "indexes, unknown folder",
+			target:   "/rest/getIndexes.view",
+			folder:   "2",
+			xmlError: &subsonicError{Code: codeNotFound},
+		},
+		{
+			name:   "folders",
+			target: "/rest/getMusicFolders.view",
+			folders: []musicFolder{
+				{ID: 0, Name: "music"},
+				{ID: 1, Name: "Audiobooks"},
+			},
+		},
+		{
+			name:     "stream, second folder",
+			target:   "/rest/stream.view",
+			id:       "1-1",
+			httpCode: http.StatusOK,
+		},
+		{
+			name:     "stream, unknown folder",
+			target:   "/rest/stream.view",
+			id:       "2-1",
+			xmlError: &subsonicError{Code: codeNotFound},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, values := configAuth()
+			if tt.folder != "" {
+				values.Set("musicFolderId", tt.folder)
+			}
+			if tt.id != "" {
+				values.Set("id", tt.id)
+			}
+
+			withFolders(t, folders, fs, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, tt.target, values)
+
+				if tt.httpCode != 0 {
+					if want, got := tt.httpCode, res.StatusCode; want != got {
+						t.Fatalf("unexpected HTTP status code:\n- want: %03d\n-  got: %03d",
+							want, got)
+					}
+
+					return
+				}
+
+				c := mustDecodeXML(t, res)
+
+				if tt.xmlError != nil {
+					if want, got := tt.xmlError.Code, c.Error.Code; want != got {
+						t.Fatalf("unexpected XML error code:\n- want: %v\n-  got: %v",
+							want, got)
+					}
+
+					return
+				}
+
+				if tt.indexes != nil {
+					mustIndexesEqual(t, tt.indexes, c.Indexes.Indexes)
+					return
+				}
+
+				if want, got := tt.folders, c.MusicFolders.MusicFolders; !reflect.DeepEqual(want, got) {
+					t.Fatalf("unexpected music folders:\n- want: %v\n-  got: %v",
+						want, got)
+				}
+			})
+		})
+	}
+}
+
 func Test_stack(t *testing.T) {
 	var s stack
 	s.Push("foo")
@@ -504,9 +1176,6 @@ func mustMusicDirectoryContainersEqual(t *testing.T, a *musicDirectoryContainer,
 		child := b.Children[i]
 
 		t.Run(ttChild.Title, func(t *testing.T) {
-			ttChild.XMLName = xml.Name{}
-			child.XMLName = xml.Name{}
-
 			if want, got := ttChild, child; !reflect.DeepEqual(want, got) {
 				t.Fatalf("unexpected child:\n- want: %v\n-  got: %v",
 					want, got)
@@ -0,0 +1,246 @@
+package mpdsub
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// hlsFormat is the Transcoder format used to produce HLS segments,
+	// which must be MPEG transport streams.  Each segment is transcoded
+	// separately, so its timestamps must begin at its offset within the
+	// file rather than at zero, such as by using ffmpeg's -output_ts_offset.
+	hlsFormat = "hls"
+
+	// hlsSegmentDuration is the maximum duration of each HLS segment.
+	hlsSegmentDuration = 10 * time.Second
+
+	// Content types of HLS playlists and segments.
+	contentTypeM3U8 = "application/vnd.apple.mpegurl"
+	contentTypeTS   = "video/MP2T"
+)
+
+// authParams are the request parameters which are copied from a playlist
+// request into the URLs it references, so that clients which do not add
+// their own credentials can retrieve them.  Plaintext passwords are never
+// copied; see authValues.
+var authParams = []string{"u", "t", "s", "apiKey", "c", "v"}
+
+// hls returns an HLS playlist for a file.  If multiple bitRate parameters are
+// specified, a master playlist containing a variant for each bitrate is
+// returned.  Otherwise, a media playlist which references segments served
+// by hlsSegment is returned.
+func (s *Server) hls(w http.ResponseWriter, r *http.Request) {
+	q := r.Form
+
+	qID := q.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	// Bitrates may be repeated or comma-separated
+	var bitRates []int
+	for _, v := range q["bitRate"] {
+		for _, b := range strings.Split(v, ",") {
+			br, err := strconv.Atoi(b)
+			if err != nil || br <= 0 {
+				writeXML(w, errGeneric)
+				return
+			}
+
+			bitRates = append(bitRates, br)
+		}
+	}
+
+	if s.cfg.Transcoder == nil || !s.cfg.Transcoder.Supports(hlsFormat) {
+		writeXML(w, errGeneric)
+		return
+	}
+
+	folder, _, file, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return
+	}
+	if file.Dir {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	if len(bitRates) > 1 {
+		w.Header().Set(contentType, contentTypeM3U8)
+		_, _ = w.Write(hlsMasterPlaylist(q, bitRates))
+		return
+	}
+
+	d, err := folder.duration(file.Name)
+	if err != nil {
+		s.logf("error retrieving duration for HLS playlist: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	bitRate := s.cfg.TranscodeBitRate
+	if len(bitRates) == 1 {
+		bitRate = bitRates[0]
+	}
+
+	w.Header().Set(contentType, contentTypeM3U8)
+	_, _ = w.Write(hlsMediaPlaylist(q, bitRate, d))
+}
+
+// hlsSegment serves a single transcoded HLS segment of a file, beginning at
+// the timeOffset parameter and lasting for the duration parameter.
+func (s *Server) hlsSegment(w http.ResponseWriter, r *http.Request) {
+	q := r.Form
+
+	qID := q.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	opts := TranscodeOptions{
+		Format:  hlsFormat,
+		BitRate: s.cfg.TranscodeBitRate,
+	}
+
+	if qBitRate := q.Get("bitRate"); qBitRate != "" {
+		br, err := strconv.Atoi(qBitRate)
+		if err != nil || br <= 0 {
+			writeXML(w, errGeneric)
+			return
+		}
+
+		opts.BitRate = br
+	}
+
+	var err error
+	if opts.Offset, err = parseSeconds(q.Get("timeOffset")); err != nil {
+		writeXML(w, errGeneric)
+		return
+	}
+	if opts.Duration, err = parseSeconds(q.Get("duration")); err != nil {
+		writeXML(w, errGeneric)
+		return
+	}
+
+	if s.cfg.Transcoder == nil || !s.cfg.Transcoder.Supports(hlsFormat) {
+		writeXML(w, errGeneric)
+		return
+	}
+
+	folder, _, file, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return
+	}
+	if file.Dir {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	f, ok := s.openFile(w, r, folder, file.Name)
+	if !ok {
+		return
+	}
+	defer f.Close()
+
+	s.transcode(w, r, f, opts, 0)
+}
+
+// hlsMasterPlaylist produces an HLS master playlist with a variant for each
+// input bitrate.  Parameters from q are used to build variant URLs.
+func hlsMasterPlaylist(q url.Values, bitRates []int) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+
+	for _, br := range bitRates {
+		v := hlsParams(q)
+		v.Set("bitRate", strconv.Itoa(br))
+
+		fmt.Fprintf(&buf, "#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=%d\n", br*1000)
+		fmt.Fprintf(&buf, "hls.m3u8?%s\n", v.Encode())
+	}
+
+	return buf.Bytes()
+}
+
+// hlsMediaPlaylist produces an HLS media playlist which divides media of
+// duration d into segments of at most hlsSegmentDuration, transcoded at the
+// input bitrate.  Parameters from q are used to build segment URLs.
+func hlsMediaPlaylist(q url.Values, bitRate int, d time.Duration) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("#EXTM3U\n")
+	buf.WriteString("#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&buf, "#EXT-X-TARGETDURATION:%d\n", int(hlsSegmentDuration.Seconds()))
+	buf.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	buf.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+
+	for offset := time.Duration(0); offset < d; offset += hlsSegmentDuration {
+		length := hlsSegmentDuration
+		if rem := d - offset; rem < length {
+			length = rem
+		}
+
+		v := hlsParams(q)
+		if bitRate > 0 {
+			v.Set("bitRate", strconv.Itoa(bitRate))
+		}
+		v.Set("timeOffset", seconds(offset))
+		v.Set("duration", seconds(length))
+
+		fmt.Fprintf(&buf, "#EXTINF:%s,\n", seconds(length))
+		fmt.Fprintf(&buf, "hls.ts?%s\n", v.Encode())
+	}
+
+	buf.WriteString("#EXT-X-ENDLIST\n")
+	return buf.Bytes()
+}
+
+// hlsParams copies the item ID and authentication parameters from q, for
+// use in URLs referenced by an HLS playlist.
+func hlsParams(q url.Values) url.Values {
+	v := authValues(q)
+	v.Set("id", q.Get("id"))
+
+	return v
+}
+
+// authValues copies the authentication parameters from q, for use in URLs
+// which are returned to a client.  If q authenticates using a password, it
+// is replaced by a token and salt, so that the password does not appear in
+// the response.
+func authValues(q url.Values) url.Values {
+	v := make(url.Values, len(authParams))
+	for _, p := range authParams {
+		if qv := q.Get(p); qv != "" {
+			v.Set(p, qv)
+		}
+	}
+
+	pass := decodePassword(q.Get("p"))
+	if pass == "" {
+		return v
+	}
+
+	// If a salt cannot be generated, clients must add their own credentials
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return v
+	}
+	salt := hex.EncodeToString(b)
+
+	h := md5.Sum([]byte(pass + salt))
+	v.Set("t", hex.EncodeToString(h[:]))
+	v.Set("s", salt)
+
+	return v
+}
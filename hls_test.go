@@ -0,0 +1,233 @@
+package mpdsub
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+func TestServer_hls(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	tests := []struct {
+		name       string
+		transcoder Transcoder
+		target     string
+		values     url.Values
+
+		xmlError    *subsonicError
+		contentType string
+		body        string
+	}{
+		{
+			name:     "no ID",
+			target:   "/rest/hls.m3u8",
+			xmlError: &subsonicError{Code: codeMissingParameter},
+		},
+		{
+			name:     "no transcoder",
+			target:   "/rest/hls.m3u8",
+			values:   url.Values{"id": {"0"}},
+			xmlError: &subsonicError{Code: codeGeneric},
+		},
+		{
+			name:       "bad bitrate",
+			transcoder: &memoryTranscoder{formats: []string{hlsFormat}},
+			target:     "/rest/hls.m3u8",
+			values:     url.Values{"id": {"0"}, "bitRate": {"foo"}},
+			xmlError:   &subsonicError{Code: codeGeneric},
+		},
+		{
+			name:        "media playlist",
+			transcoder:  &memoryTranscoder{formats: []string{hlsFormat}},
+			target:      "/rest/hls.m3u8",
+			values:      url.Values{"id": {"0"}, "bitRate": {"128"}},
+			contentType: contentTypeM3U8,
+			body: strings.Join([]string{
+				"#EXTM3U",
+				"#EXT-X-VERSION:3",
+				"#EXT-X-TARGETDURATION:10",
+				"#EXT-X-MEDIA-SEQUENCE:0",
+				"#EXT-X-PLAYLIST-TYPE:VOD",
+				"#EXTINF:10.000,",
+				"hls.ts?bitRate=128&c=test&duration=10.000&id=0&s=salt&t=315240c61218a4a861ec949166a85ef0&timeOffset=0.000&u=test&v=1.14.0",
+				"#EXTINF:2.500,",
+				"hls.ts?bitRate=128&c=test&duration=2.500&id=0&s=salt&t=315240c61218a4a861ec949166a85ef0&timeOffset=10.000&u=test&v=1.14.0",
+				"#EXT-X-ENDLIST",
+				"",
+			}, "\n"),
+		},
+		{
+			name:        "master playlist",
+			transcoder:  &memoryTranscoder{formats: []string{hlsFormat}},
+			target:      "/rest/hls.m3u8",
+			values:      url.Values{"id": {"0"}, "bitRate": {"64,128"}},
+			contentType: contentTypeM3U8,
+			body: strings.Join([]string{
+				"#EXTM3U",
+				"#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=64000",
+				"hls.m3u8?bitRate=64&c=test&id=0&s=salt&t=315240c61218a4a861ec949166a85ef0&u=test&v=1.14.0",
+				"#EXT-X-STREAM-INF:PROGRAM-ID=1,BANDWIDTH=128000",
+				"hls.m3u8?bitRate=128&c=test&id=0&s=salt&t=315240c61218a4a861ec949166a85ef0&u=test&v=1.14.0",
+				"",
+			}, "\n"),
+		},
+		{
+			name:       "segment, bad offset",
+			transcoder: &memoryTranscoder{formats: []string{hlsFormat}},
+			target:     "/rest/hls.ts",
+			values:     url.Values{"id": {"0"}, "timeOffset": {"-1"}},
+			xmlError:   &subsonicError{Code: codeGeneric},
+		},
+		{
+			name:        "segment",
+			transcoder:  &memoryTranscoder{formats: []string{hlsFormat}},
+			target:      "/rest/hls.ts",
+			values:      url.Values{"id": {"0"}, "bitRate": {"128"}, "timeOffset": {"10"}, "duration": {"2.5"}},
+			contentType: contentTypeTS,
+			body:        "hls:128:10:flac",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &memoryDatabase{
+				files: []string{"foo.flac"},
+				info: map[string]mpd.Attrs{
+					"foo.flac": {
+						"file":     "foo.flac",
+						"duration": "12.5",
+					},
+				},
+			}
+			fs := &memoryFilesystem{
+				files: map[string]*memoryFile{
+					filepath.Join(musicDirectory, "foo.flac"): &memoryFile{
+						ReadSeeker: strings.NewReader(`flac`),
+					},
+				},
+			}
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = musicDirectory
+			cfg.Transcoder = tt.transcoder
+
+			// Use token authentication so that playlists are predictable
+			values.Del("p")
+			values.Set("t", "315240c61218a4a861ec949166a85ef0")
+			values.Set("s", "salt")
+
+			for k, v := range tt.values {
+				values[k] = v
+			}
+
+			withServer(t, db, fs, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, tt.target, values)
+
+				if tt.xmlError != nil {
+					c := mustDecodeXML(t, res)
+					if want, got := tt.xmlError.Code, c.Error.Code; want != got {
+						t.Fatalf("unexpected XML error code::\n- want: %v\n-  got: %v",
+							want, got)
+					}
+
+					return
+				}
+
+				if want, got := tt.contentType, res.Header.Get(contentType); want != got {
+					t.Fatalf("unexpected Content-Type header:\n- want: %q\n-  got: %q",
+						want, got)
+				}
+
+				b, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatalf("failed to read body: %v", err)
+				}
+				_ = res.Body.Close()
+
+				if want, got := tt.body, string(b); want != got {
+					t.Fatalf("unexpected body:\n- want: %q\n-  got: %q",
+						want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServer_hlsPassword(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	db := &memoryDatabase{
+		files: []string{"foo.flac"},
+		info: map[string]mpd.Attrs{
+			"foo.flac": {
+				"file":     "foo.flac",
+				"duration": "12.5",
+			},
+		},
+	}
+	fs := &memoryFilesystem{
+		files: map[string]*memoryFile{
+			filepath.Join(musicDirectory, "foo.flac"): &memoryFile{
+				ReadSeeker: strings.NewReader(`flac`),
+			},
+		},
+	}
+
+	cfg, values := configAuth()
+	cfg.MusicDirectory = musicDirectory
+	cfg.Transcoder = &memoryTranscoder{formats: []string{hlsFormat}}
+	values.Set("id", "0")
+
+	withServer(t, db, fs, cfg, func(base string) {
+		res := testRequest(t, base, http.MethodGet, "/rest/hls.m3u8", values)
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+		_ = res.Body.Close()
+
+		// Find the first segment, whose URL must not contain the password,
+		// but must still authenticate the client
+		var segment string
+		for _, l := range strings.Split(string(b), "\n") {
+			if strings.HasPrefix(l, "hls.ts?") {
+				segment = l
+				break
+			}
+		}
+
+		q, err := url.ParseQuery(strings.TrimPrefix(segment, "hls.ts?"))
+		if err != nil {
+			t.Fatalf("failed to parse segment URL %q: %v", segment, err)
+		}
+		if q.Get("p") != "" || q.Get("t") == "" || q.Get("s") == "" {
+			t.Fatalf("unexpected segment credentials: %q", segment)
+		}
+
+		res = testRequest(t, base, http.MethodGet, "/rest/hls.ts", q)
+		defer res.Body.Close()
+
+		if want, got := contentTypeTS, res.Header.Get(contentType); want != got {
+			t.Fatalf("unexpected Content-Type header:\n- want: %q\n-  got: %q",
+				want, got)
+		}
+	})
+}
+
+func Test_hlsMediaPlaylistSegments(t *testing.T) {
+	b := hlsMediaPlaylist(url.Values{"id": {"0"}}, 0, 30*time.Second)
+
+	if want, got := 3, strings.Count(string(b), "#EXTINF:10.000,"); want != got {
+		t.Fatalf("unexpected number of segments:\n- want: %v\n-  got: %v", want, got)
+	}
+	if strings.Contains(string(b), "bitRate") {
+		t.Fatal("segment URLs should not contain a bitrate when none is configured")
+	}
+}
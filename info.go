@@ -0,0 +1,448 @@
+package mpdsub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+// Names of sidecar files which describe artists and albums.  NFO files use
+// the format written by Kodi and other media managers.
+const (
+	artistNFOFile = "artist.nfo"
+	albumNFOFile  = "album.nfo"
+	biographyFile = "biography.txt"
+)
+
+var (
+	// artistImageFiles are the names of artist image sidecar files, in
+	// order of preference.
+	artistImageFiles = []string{"artist.jpg", "artist.png"}
+
+	// coverArtFiles are the names of album cover sidecar files, in order
+	// of preference.
+	coverArtFiles = []string{"cover.jpg", "cover.png", "folder.jpg", "folder.png", "front.jpg", "front.png"}
+)
+
+// artistCoverArtPrefix prefixes the cover art ID of an artist image, so that
+// it is not confused with an album cover stored in the same directory.
+const artistCoverArtPrefix = "ar-"
+
+const (
+	// coverArtPrefix is the URL path prefix of the signed cover art URLs
+	// returned in artist and album info, which clients retrieve directly
+	// without Subsonic credentials.
+	coverArtPrefix = "/coverart/"
+
+	// coverArtURLExpiry is the length of time for which a signed cover art
+	// URL is valid.
+	coverArtURLExpiry = 24 * time.Hour
+)
+
+// An artistNFO is the subset of an artist.nfo file used for artist info.
+type artistNFO struct {
+	MusicBrainzID string `xml:"musicBrainzArtistID"`
+	Biography     string `xml:"biography"`
+}
+
+// An albumNFO is the subset of an album.nfo file used for album info.
+type albumNFO struct {
+	MusicBrainzID string `xml:"musicBrainzAlbumID"`
+	Review        string `xml:"review"`
+}
+
+// getArtistInfo returns information about the artist of an item.
+func (s *Server) getArtistInfo(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.artistInfo(w, r)
+	if !ok {
+		return
+	}
+
+	writeXML(w, func(c *container) {
+		c.ArtistInfo = info
+	})
+}
+
+// getArtistInfo2 returns information about the artist of an item.  Items are
+// identified by the same IDs as getArtistInfo, because the Server does not
+// organize files by their tags.
+func (s *Server) getArtistInfo2(w http.ResponseWriter, r *http.Request) {
+	info, ok := s.artistInfo(w, r)
+	if !ok {
+		return
+	}
+
+	writeXML(w, func(c *container) {
+		c.ArtistInfo2 = info
+	})
+}
+
+// artistInfo gathers information about the artist of the item specified by
+// the id parameter.  Artist sidecar files may be stored in an album's
+// directory or in any directory above it, and the nearest take precedence.
+// If a parameter is invalid, an error is written to w and artistInfo returns
+// false.
+func (s *Server) artistInfo(w http.ResponseWriter, r *http.Request) (*artistInfo, bool) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return nil, false
+	}
+
+	folder, files, item, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return nil, false
+	}
+
+	dir, sample, hasSample := infoItem(requestUser(r), files, item)
+
+	info := &artistInfo{}
+	for d := dir; d != "."; d = filepath.Dir(d) {
+		var nfo artistNFO
+		if err := s.readNFO(folder, filepath.Join(d, artistNFOFile), &nfo); err != nil {
+			s.logf("error reading artist info in %q: %v", d, err)
+			writeXML(w, errGeneric)
+			return nil, false
+		}
+
+		if info.Biography == "" {
+			info.Biography = strings.TrimSpace(nfo.Biography)
+		}
+		if info.MusicBrainzID == "" {
+			info.MusicBrainzID = strings.TrimSpace(nfo.MusicBrainzID)
+		}
+
+		if info.Biography == "" {
+			text, err := s.readSidecarText(folder, filepath.Join(d, biographyFile))
+			if err != nil {
+				s.logf("error reading artist biography in %q: %v", d, err)
+				writeXML(w, errGeneric)
+				return nil, false
+			}
+
+			info.Biography = text
+		}
+
+		if info.LargeImageURL == "" {
+			_, found, err := s.findSidecar(folder, d, artistImageFiles)
+			if err != nil {
+				s.logf("error finding artist image in %q: %v", d, err)
+				writeXML(w, errGeneric)
+				return nil, false
+			}
+
+			// Images are served by the ID of the directory containing them
+			if f, ok := findDir(files, d); found && ok {
+				u := s.coverArtURL(r, artistCoverArtPrefix+formatID(folder.ID, f.ID))
+				info.SmallImageURL, info.MediumImageURL, info.LargeImageURL = u, u, u
+			}
+		}
+	}
+
+	if info.MusicBrainzID == "" && hasSample {
+		tags, err := fileTags(folder, sample.Name)
+		if err != nil {
+			s.logf("error reading tags for %q: %v", sample.Name, err)
+			writeXML(w, errGeneric)
+			return nil, false
+		}
+
+		info.MusicBrainzID = firstTag(tags, "MUSICBRAINZ_ARTISTID", "MUSICBRAINZ_ALBUMARTISTID")
+	}
+
+	return info, true
+}
+
+// getAlbumInfo returns information about the album of an item.  It also
+// serves getAlbumInfo2, because the Server does not organize files by their
+// tags.
+func (s *Server) getAlbumInfo(w http.ResponseWriter, r *http.Request) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	folder, files, item, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return
+	}
+
+	dir, sample, hasSample := infoItem(requestUser(r), files, item)
+
+	var nfo albumNFO
+	if err := s.readNFO(folder, filepath.Join(dir, albumNFOFile), &nfo); err != nil {
+		s.logf("error reading album info in %q: %v", dir, err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	info := &albumInfo{
+		Notes:         strings.TrimSpace(nfo.Review),
+		MusicBrainzID: strings.TrimSpace(nfo.MusicBrainzID),
+	}
+
+	_, ok, err := s.findSidecar(folder, dir, coverArtFiles)
+	if err != nil {
+		s.logf("error finding cover art in %q: %v", dir, err)
+		writeXML(w, errGeneric)
+		return
+	}
+	if ok {
+		u := s.coverArtURL(r, formatID(folder.ID, item.ID))
+		info.SmallImageURL, info.MediumImageURL, info.LargeImageURL = u, u, u
+	}
+
+	if info.MusicBrainzID == "" && hasSample {
+		tags, err := fileTags(folder, sample.Name)
+		if err != nil {
+			s.logf("error reading tags for %q: %v", sample.Name, err)
+			writeXML(w, errGeneric)
+			return
+		}
+
+		info.MusicBrainzID = firstTag(tags, "MUSICBRAINZ_ALBUMID")
+	}
+
+	writeXML(w, func(c *container) {
+		c.AlbumInfo = info
+	})
+}
+
+// getCoverArt serves the cover image stored in the directory of an item.  IDs
+// with artistCoverArtPrefix serve the artist image instead.  Images are
+// served as-is, regardless of the size parameter.
+func (s *Server) getCoverArt(w http.ResponseWriter, r *http.Request) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	names := coverArtFiles
+	if strings.HasPrefix(qID, artistCoverArtPrefix) {
+		qID = strings.TrimPrefix(qID, artistCoverArtPrefix)
+		names = artistImageFiles
+	}
+
+	folder, _, item, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return
+	}
+
+	dir := item.Name
+	if !item.Dir {
+		dir = filepath.Dir(item.Name)
+	}
+
+	name, ok, err := s.findSidecar(folder, dir, names)
+	if err != nil {
+		s.logf("error finding cover art in %q: %v", dir, err)
+		writeXML(w, errGeneric)
+		return
+	}
+	if !ok {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	f, ok := s.openFile(w, r, folder, name)
+	if !ok {
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		s.logf("error stat'ing cover art: %q", name)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	http.ServeContent(w, r, name, stat.ModTime(), f)
+}
+
+// coverArtURL returns an absolute URL from which the requesting user may
+// retrieve the cover art with the input ID, without credentials, until the
+// URL expires.  It returns an empty string if the user may not retrieve cover
+// art, or if URLs cannot be signed.
+func (s *Server) coverArtURL(r *http.Request, id string) string {
+	u := requestUser(r)
+	if !u.can(RoleCoverArt) || s.artKey == nil {
+		return ""
+	}
+
+	expires := strconv.FormatInt(time.Now().Add(coverArtURLExpiry).Unix(), 10)
+
+	out := s.baseURL(r)
+	out.Path = coverArtPrefix + id
+	out.RawQuery = url.Values{
+		"u":       []string{u.Name},
+		"expires": []string{expires},
+		"sig":     []string{s.signCoverArt(id, u.Name, expires)},
+	}.Encode()
+
+	return out.String()
+}
+
+// signCoverArt produces the signature of a cover art URL for the input cover
+// art ID, user, and expiry time.
+func (s *Server) signCoverArt(id, user, expires string) string {
+	mac := hmac.New(sha256.New, s.artKey)
+	_, _ = io.WriteString(mac, id+"\n"+user+"\n"+expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// serveSignedCoverArt serves cover art from a URL produced by coverArtURL,
+// as the user for whom the URL was signed.
+func (s *Server) serveSignedCoverArt(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, coverArtPrefix)
+	name := r.Form.Get("u")
+	expires := r.Form.Get("expires")
+
+	want := s.signCoverArt(id, name, expires)
+	if s.artKey == nil || !hmac.Equal([]byte(want), []byte(r.Form.Get("sig"))) {
+		http.NotFound(w, r)
+		return
+	}
+
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().After(time.Unix(t, 0)) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The user's access may have changed since the URL was signed
+	u, ok := s.users[name]
+	if !ok || !u.can(RoleCoverArt) {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.Form.Set("id", id)
+	s.getCoverArt(w, withUser(r, u))
+}
+
+// infoItem determines the directory described by item, and a file whose tags
+// describe the directory.  If item is a file, its own directory is used.  It
+// returns false if there is no such file which u may access.
+func infoItem(u *User, files []indexedFile, item indexedFile) (string, indexedFile, bool) {
+	if !item.Dir {
+		return filepath.Dir(item.Name), item, true
+	}
+
+	prefix := item.Name + string(os.PathSeparator)
+	for _, f := range files {
+		if !f.Dir && strings.HasPrefix(f.Name, prefix) && u.allowed(f.Name) {
+			return item.Name, f, true
+		}
+	}
+
+	return item.Name, indexedFile{}, false
+}
+
+// findDir returns the directory with the specified name from an input slice
+// produced by indexFiles, if it exists.
+func findDir(files []indexedFile, name string) (indexedFile, bool) {
+	for _, f := range files {
+		if f.Dir && f.Name == name {
+			return f, true
+		}
+	}
+
+	return indexedFile{}, false
+}
+
+// fileTags returns the tags MPD has read from the file with the input name in
+// folder.  Remote files have no tags.
+func fileTags(folder *folder, name string) (mpd.Attrs, error) {
+	if _, ok := folder.remoteURL(name); ok {
+		return nil, nil
+	}
+
+	infos, err := folder.db.ListAllInfo(name)
+	if err != nil || len(infos) == 0 {
+		return nil, err
+	}
+
+	return infos[0], nil
+}
+
+// firstTag returns the value of the first of the input tags which is set.
+func firstTag(attrs mpd.Attrs, tags ...string) string {
+	for _, t := range tags {
+		if v := attrs[t]; v != "" {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// findSidecar returns the name of the first sidecar file from names which
+// exists in directory dir of folder.
+func (s *Server) findSidecar(folder *folder, dir string, names []string) (string, bool, error) {
+	for _, n := range names {
+		name := filepath.Join(dir, n)
+
+		f, ok, err := s.openSidecar(folder, name)
+		if err != nil {
+			return "", false, err
+		}
+		if ok {
+			_ = f.Close()
+			return name, true, nil
+		}
+	}
+
+	return "", false, nil
+}
+
+// readNFO decodes the NFO sidecar file with the input name in folder into v.
+// If the file does not exist, v is left unchanged.  Errors decoding the file
+// are not returned, so v may be incomplete if the file is malformed.
+func (s *Server) readNFO(folder *folder, name string, v interface{}) error {
+	f, ok, err := s.openSidecar(folder, name)
+	if err != nil || !ok {
+		return err
+	}
+	defer f.Close()
+
+	// NFO files are often written by hand or by other tools, so a malformed
+	// file is treated as though it contains no information
+	if err := xml.NewDecoder(f).Decode(v); err != nil && s.cfg.Verbose {
+		s.logf("ignoring malformed NFO file %q: %v", name, err)
+	}
+
+	return nil
+}
+
+// readSidecarText reads the plain text sidecar file with the input name in
+// folder.  It returns an empty string if the file does not exist.
+func (s *Server) readSidecarText(folder *folder, name string) (string, error) {
+	f, ok, err := s.openSidecar(folder, name)
+	if err != nil || !ok {
+		return "", err
+	}
+	defer f.Close()
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(b)), nil
+}
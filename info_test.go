@@ -0,0 +1,291 @@
+package mpdsub
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+// infoFixtures returns a database and filesystem which store artist and album
+// information in several ways.
+func infoFixtures(musicDirectory string) (*memoryDatabase, *memoryFilesystem) {
+	db := &memoryDatabase{
+		files: []string{
+			"Artist/Album/01.mp3",
+			"Artist/Album/02.mp3",
+			"Other/Album/03.mp3",
+		},
+		info: map[string]mpd.Attrs{
+			"Artist/Album/01.mp3": {},
+			"Other/Album/03.mp3": {
+				"MUSICBRAINZ_ARTISTID": "other-artist",
+				"MUSICBRAINZ_ALBUMID":  "other-album",
+			},
+		},
+	}
+
+	sidecar := func(s string) *memoryFile {
+		return &memoryFile{ReadSeeker: strings.NewReader(s)}
+	}
+
+	fs := &memoryFilesystem{
+		files: map[string]*memoryFile{
+			filepath.Join(musicDirectory, "Artist/artist.nfo"): sidecar(`<?xml version="1.0" encoding="UTF-8" standalone="yes" ?>
+<artist>
+	<name>Artist</name>
+	<musicBrainzArtistID>artist</musicBrainzArtistID>
+	<biography>
+		From NFO.
+	</biography>
+</artist>`),
+			filepath.Join(musicDirectory, "Artist/artist.jpg"): sidecar("artist image"),
+			filepath.Join(musicDirectory, "Artist/Album/album.nfo"): sidecar(`<album>
+	<title>Album</title>
+	<musicBrainzAlbumID>album</musicBrainzAlbumID>
+	<review>Notes.</review>
+</album>`),
+			filepath.Join(musicDirectory, "Artist/Album/cover.jpg"): sidecar("album cover"),
+			filepath.Join(musicDirectory, "Other/artist.nfo"):       sidecar("<<< not XML"),
+			filepath.Join(musicDirectory, "Other/biography.txt"):    sidecar("From text.\n"),
+		},
+	}
+
+	return db, fs
+}
+
+func TestServer_getArtistInfo(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	tests := []struct {
+		name   string
+		target string
+		id     string
+		info   artistInfo
+		image  string
+	}{
+		{
+			name:   "NFO from song",
+			target: "/rest/getArtistInfo.view",
+			id:     "2",
+			info: artistInfo{
+				Biography:     "From NFO.",
+				MusicBrainzID: "artist",
+			},
+			image: "ar-0",
+		},
+		{
+			name:   "NFO from artist, version 2",
+			target: "/rest/getArtistInfo2.view",
+			id:     "0",
+			info: artistInfo{
+				Biography:     "From NFO.",
+				MusicBrainzID: "artist",
+			},
+			image: "ar-0",
+		},
+		{
+			name:   "malformed NFO, text and tags",
+			target: "/rest/getArtistInfo.view",
+			id:     "5",
+			info: artistInfo{
+				Biography:     "From text.",
+				MusicBrainzID: "other-artist",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fs := infoFixtures(musicDirectory)
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = musicDirectory
+
+			withServer(t, db, fs, cfg, func(base string) {
+				values.Set("id", tt.id)
+				c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, tt.target, values))
+
+				info := c.ArtistInfo
+				if strings.HasSuffix(tt.target, "2.view") {
+					info = c.ArtistInfo2
+				}
+				if info == nil {
+					t.Fatalf("no artist info in response: %+v", c)
+				}
+
+				got := *info
+				if tt.image != "" {
+					mustCoverArtURLs(t, base, tt.image, "artist image", got.SmallImageURL, got.MediumImageURL, got.LargeImageURL)
+					got.SmallImageURL, got.MediumImageURL, got.LargeImageURL = "", "", ""
+				}
+
+				if want := tt.info; !reflect.DeepEqual(want, got) {
+					t.Fatalf("unexpected artist info:\n- want: %+v\n-  got: %+v", want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServer_getAlbumInfo(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	tests := []struct {
+		name  string
+		id    string
+		info  albumInfo
+		image bool
+	}{
+		{
+			name: "NFO",
+			id:   "1",
+			info: albumInfo{
+				Notes:         "Notes.",
+				MusicBrainzID: "album",
+			},
+			image: true,
+		},
+		{
+			name: "tags",
+			id:   "5",
+			info: albumInfo{
+				MusicBrainzID: "other-album",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fs := infoFixtures(musicDirectory)
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = musicDirectory
+
+			withServer(t, db, fs, cfg, func(base string) {
+				values.Set("id", tt.id)
+				c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/getAlbumInfo2.view", values))
+
+				got := *c.AlbumInfo
+				if tt.image {
+					mustCoverArtURLs(t, base, tt.id, "album cover", got.SmallImageURL, got.MediumImageURL, got.LargeImageURL)
+					got.SmallImageURL, got.MediumImageURL, got.LargeImageURL = "", "", ""
+				}
+
+				if want := tt.info; !reflect.DeepEqual(want, got) {
+					t.Fatalf("unexpected album info:\n- want: %+v\n-  got: %+v", want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServer_getCoverArt(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	tests := []struct {
+		name string
+		id   string
+		body string
+		code int
+	}{
+		{
+			name: "album cover from song",
+			id:   "2",
+			body: "album cover",
+		},
+		{
+			name: "artist image",
+			id:   "ar-0",
+			body: "artist image",
+		},
+		{
+			name: "no cover",
+			id:   "5",
+			code: codeNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, fs := infoFixtures(musicDirectory)
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = musicDirectory
+			values.Set("id", tt.id)
+
+			withServer(t, db, fs, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, "/rest/getCoverArt.view", values)
+				if tt.code != 0 {
+					c := mustDecodeXML(t, res)
+					if want, got := tt.code, c.Error.Code; want != got {
+						t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+					}
+					return
+				}
+				defer res.Body.Close()
+
+				b, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatalf("failed to read cover art: %v", err)
+				}
+
+				if want, got := tt.body, string(b); want != got {
+					t.Fatalf("unexpected cover art:\n- want: %q\n-  got: %q", want, got)
+				}
+			})
+		})
+	}
+}
+
+// mustCoverArtURLs verifies that the image URLs from artist or album info all
+// refer to the signed cover art with the input ID, and that the cover art can
+// be retrieved from them without credentials.  Tampering with the URL must
+// prevent retrieval.
+func mustCoverArtURLs(t *testing.T, base, id, body string, urls ...string) {
+	for _, u := range urls {
+		if u != urls[0] {
+			t.Fatalf("image URLs differ: %q", urls)
+		}
+	}
+
+	if want, got := base+coverArtPrefix+id+"?", urls[0]; !strings.HasPrefix(got, want) {
+		t.Fatalf("unexpected image URL:\n- want prefix: %q\n-  got: %q", want, got)
+	}
+
+	get := func(u string) (int, string) {
+		res, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("failed to perform HTTP request: %v", err)
+		}
+		defer res.Body.Close()
+
+		b, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Fatalf("failed to read body: %v", err)
+		}
+
+		return res.StatusCode, string(b)
+	}
+
+	if code, got := get(urls[0]); code != http.StatusOK || got != body {
+		t.Fatalf("unexpected cover art: %d, %q", code, got)
+	}
+
+	u, err := url.Parse(urls[0])
+	if err != nil {
+		t.Fatalf("failed to parse image URL: %v", err)
+	}
+	q := u.Query()
+	q.Set("u", "other")
+	u.RawQuery = q.Encode()
+
+	if code, _ := get(u.String()); code != http.StatusNotFound {
+		t.Fatalf("unexpected HTTP status for tampered URL: %d", code)
+	}
+}
@@ -0,0 +1,336 @@
+package mpdsub
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+// lyricsExts are the extensions of sidecar lyrics files which may be stored
+// beside a file, in order of preference.
+var lyricsExts = []string{".lrc", ".txt"}
+
+// lyricsTags are the tags read from MPD comments which may contain lyrics.
+var lyricsTags = []string{"LYRICS", "UNSYNCEDLYRICS"}
+
+// maxLyricsCandidates is the maximum number of files matching the getLyrics
+// parameters whose comments are read while searching for lyrics.
+const maxLyricsCandidates = 10
+
+// lyrics are the lyrics for a file, which may be synchronized with the file
+// using a start time for each line.
+type lyrics struct {
+	Lang   string
+	Offset time.Duration
+	Synced bool
+	Lines  []lyricsLine
+}
+
+// A lyricsLine is a single line of lyrics.  Start is only set for
+// synchronized lyrics.
+type lyricsLine struct {
+	Start time.Duration
+	Text  string
+}
+
+// text returns the lyrics as plain text, without timestamps.
+func (l lyrics) text() string {
+	ss := make([]string, 0, len(l.Lines))
+	for _, ln := range l.Lines {
+		ss = append(ss, ln.Text)
+	}
+
+	return strings.Join(ss, "\n")
+}
+
+var (
+	// lrcTimestamp matches a single LRC timestamp, such as [01:23.45].
+	lrcTimestamp = regexp.MustCompile(`^\[(\d+):(\d{1,2}(?:[.:]\d{1,3})?)\]`)
+
+	// lrcTag matches an LRC metadata tag, such as [offset:+250].
+	lrcTag = regexp.MustCompile(`^\[([a-z]+):(.*)\]$`)
+)
+
+// parseLyrics parses lyrics from r.  LRC timestamps are parsed into
+// synchronized lines, and any other input is treated as plain text lines.
+func parseLyrics(r io.Reader) (lyrics, error) {
+	var (
+		l     lyrics
+		plain []lyricsLine
+	)
+
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+
+		// A line may be prefixed with multiple timestamps when it is
+		// repeated throughout a song
+		var starts []time.Duration
+		for {
+			m := lrcTimestamp.FindStringSubmatch(line)
+			if m == nil {
+				break
+			}
+
+			min, _ := strconv.Atoi(m[1])
+			sec, _ := strconv.ParseFloat(strings.Replace(m[2], ":", ".", 1), 64)
+			starts = append(starts, time.Duration(min)*time.Minute+
+				time.Duration(sec*float64(time.Second)))
+
+			line = line[len(m[0]):]
+		}
+
+		if len(starts) > 0 {
+			l.Synced = true
+			for _, start := range starts {
+				l.Lines = append(l.Lines, lyricsLine{
+					Start: start,
+					Text:  strings.TrimSpace(line),
+				})
+			}
+			continue
+		}
+
+		if m := lrcTag.FindStringSubmatch(strings.TrimSpace(line)); m != nil {
+			switch m[1] {
+			case "la":
+				l.Lang = strings.TrimSpace(m[2])
+			case "offset":
+				ms, err := strconv.Atoi(strings.TrimSpace(m[2]))
+				if err == nil {
+					l.Offset = time.Duration(ms) * time.Millisecond
+				}
+			}
+			continue
+		}
+
+		plain = append(plain, lyricsLine{Text: line})
+	}
+	if err := s.Err(); err != nil {
+		return lyrics{}, err
+	}
+
+	if !l.Synced {
+		// Trim blank lines from the end of plain text lyrics
+		for len(plain) > 0 && strings.TrimSpace(plain[len(plain)-1].Text) == "" {
+			plain = plain[:len(plain)-1]
+		}
+
+		l.Lines = plain
+		return l, nil
+	}
+
+	sort.SliceStable(l.Lines, func(i, j int) bool {
+		return l.Lines[i].Start < l.Lines[j].Start
+	})
+
+	return l, nil
+}
+
+// fileLyrics returns all of the lyrics available for the file with the
+// input name in folder, first from sidecar files, and then from the file's
+// MPD comments.
+func (s *Server) fileLyrics(folder *folder, name string, attrs mpd.Attrs) ([]lyrics, error) {
+	var out []lyrics
+
+	// Remote files have no sidecar files
+	if _, ok := folder.remoteURL(name); !ok {
+		base := strings.TrimSuffix(name, filepath.Ext(name))
+		for _, ext := range lyricsExts {
+			l, ok, err := s.sidecarLyrics(folder, base+ext)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				out = append(out, l)
+			}
+		}
+	}
+
+	for _, tag := range lyricsTags {
+		v := attrs[tag]
+		if v == "" {
+			continue
+		}
+
+		l, err := parseLyrics(strings.NewReader(v))
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, l)
+	}
+
+	return out, nil
+}
+
+// sidecarLyrics parses lyrics from the sidecar file with the input name in
+// folder.  It returns false if the file does not exist or may not be opened.
+func (s *Server) sidecarLyrics(folder *folder, name string) (lyrics, bool, error) {
+	f, ok, err := s.openSidecar(folder, name)
+	if err != nil || !ok {
+		return lyrics{}, false, err
+	}
+	defer f.Close()
+
+	l, err := parseLyrics(f)
+	if err != nil {
+		return lyrics{}, false, err
+	}
+
+	return l, len(l.Lines) > 0, nil
+}
+
+// getLyrics returns plain text lyrics for the first file which matches the
+// artist and title parameters.  If no lyrics are found, an empty lyrics
+// element is returned.
+//
+// Finding a match requires listing the tags of every file, and reading the
+// comments of each matching file, so only the first maxLyricsCandidates
+// matches are checked for lyrics.
+func (s *Server) getLyrics(w http.ResponseWriter, r *http.Request) {
+	qArtist := r.Form.Get("artist")
+	qTitle := r.Form.Get("title")
+
+	out := &lyricsContainer{
+		Artist: qArtist,
+		Title:  qTitle,
+	}
+
+	if qArtist != "" || qTitle != "" {
+		u := requestUser(r)
+		var candidates int
+
+	search:
+		for _, f := range s.folders {
+			// All tags are listed at once, rather than reading comments
+			// for each file in turn
+			infos, err := f.db.ListAllInfo("")
+			if err != nil {
+				s.logf("error listing files from mpd for getting lyrics: %v", err)
+				writeXML(w, errGeneric)
+				return
+			}
+
+			for _, info := range infos {
+				name := info["file"]
+				if name == "" || !u.allowed(name) {
+					continue
+				}
+				if qArtist != "" && !strings.EqualFold(qArtist, info["Artist"]) {
+					continue
+				}
+				if qTitle != "" && !strings.EqualFold(qTitle, info["Title"]) {
+					continue
+				}
+
+				if candidates == maxLyricsCandidates {
+					break search
+				}
+				candidates++
+
+				// Another matching file may still have lyrics, so a file
+				// which cannot be read does not fail the request
+				attrs, err := f.db.ReadComments(name)
+				if err != nil {
+					s.logf("error reading comments for %q: %v", name, err)
+					continue
+				}
+
+				ls, err := s.fileLyrics(f, name, attrs)
+				if err != nil {
+					s.logf("error reading lyrics for %q: %v", name, err)
+					continue
+				}
+				if len(ls) == 0 {
+					continue
+				}
+
+				out.Artist = info["Artist"]
+				out.Title = info["Title"]
+				out.Value = ls[0].text()
+				break search
+			}
+		}
+	}
+
+	writeXML(w, func(c *container) {
+		c.Lyrics = out
+	})
+}
+
+// getLyricsBySongId returns all of the lyrics available for a file, with
+// start times for each line of synchronized lyrics.
+func (s *Server) getLyricsBySongId(w http.ResponseWriter, r *http.Request) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	folder, _, file, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return
+	}
+	if file.Dir {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	attrs, err := folder.db.ReadComments(file.Name)
+	if err != nil {
+		s.logf("error reading comments for %q: %v", file.Name, err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	ls, err := s.fileLyrics(folder, file.Name, attrs)
+	if err != nil {
+		s.logf("error reading lyrics for %q: %v", file.Name, err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	structured := make([]structuredLyrics, 0, len(ls))
+	for _, l := range ls {
+		lang := l.Lang
+		if lang == "" {
+			// OpenSubsonic uses "xxx" for an unknown language
+			lang = "xxx"
+		}
+
+		lines := make([]lyricsLineElement, 0, len(l.Lines))
+		for _, ln := range l.Lines {
+			e := lyricsLineElement{Value: ln.Text}
+			if l.Synced {
+				start := int64(ln.Start / time.Millisecond)
+				e.Start = &start
+			}
+
+			lines = append(lines, e)
+		}
+
+		structured = append(structured, structuredLyrics{
+			DisplayArtist: attrs["ARTIST"],
+			DisplayTitle:  attrs["TITLE"],
+			Lang:          lang,
+			Offset:        int64(l.Offset / time.Millisecond),
+			Synced:        l.Synced,
+			Lines:         lines,
+		})
+	}
+
+	writeXML(w, func(c *container) {
+		c.LyricsList = &lyricsListContainer{
+			StructuredLyrics: structured,
+		}
+	})
+}
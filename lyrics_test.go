@@ -0,0 +1,195 @@
+package mpdsub
+
+import (
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+func Test_parseLyrics(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		l    lyrics
+	}{
+		{
+			name: "plain",
+			in:   "one\r\n\r\ntwo\n\n\n",
+			l: lyrics{
+				Lines: []lyricsLine{
+					{Text: "one"},
+					{Text: ""},
+					{Text: "two"},
+				},
+			},
+		},
+		{
+			name: "synced",
+			in: strings.Join([]string{
+				"[ar:Artist]",
+				"[la:eng]",
+				"[offset:-250]",
+				"[00:01.50]one",
+				"[00:03.00][01:00.00] chorus",
+				"[00:10.25]two",
+			}, "\n"),
+			l: lyrics{
+				Lang:   "eng",
+				Offset: -250 * time.Millisecond,
+				Synced: true,
+				Lines: []lyricsLine{
+					{Start: 1500 * time.Millisecond, Text: "one"},
+					{Start: 3 * time.Second, Text: "chorus"},
+					{Start: 10250 * time.Millisecond, Text: "two"},
+					{Start: 1 * time.Minute, Text: "chorus"},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := parseLyrics(strings.NewReader(tt.in))
+			if err != nil {
+				t.Fatalf("failed to parse lyrics: %v", err)
+			}
+
+			if want, got := tt.l, l; !reflect.DeepEqual(want, got) {
+				t.Fatalf("unexpected lyrics:\n- want: %+v\n-  got: %+v", want, got)
+			}
+		})
+	}
+}
+
+func TestServer_getLyrics(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	db := &memoryDatabase{
+		// 0.mp3 has no comments, so reading them fails
+		files: []string{"0.mp3", "a.mp3", "b.mp3", "c.mp3"},
+		attrs: map[string]mpd.Attrs{
+			"a.mp3": {},
+			"b.mp3": {},
+			"c.mp3": {"LYRICS": "from tags"},
+		},
+		info: map[string]mpd.Attrs{
+			"0.mp3": {"Artist": "Artist", "Title": "Tags"},
+			"a.mp3": {"Artist": "Artist", "Title": "Sidecar"},
+			"b.mp3": {"Artist": "Artist", "Title": "None"},
+			"c.mp3": {"Artist": "Artist", "Title": "Tags"},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		artist string
+		title  string
+		value  string
+	}{
+		{
+			name:   "sidecar",
+			artist: "artist",
+			title:  "sidecar",
+			value:  "one\ntwo",
+		},
+		{
+			name:  "tags",
+			title: "Tags",
+			value: "from tags",
+		},
+		{
+			name:   "no lyrics",
+			artist: "Artist",
+			title:  "None",
+		},
+		{
+			name:  "no match",
+			title: "Unknown",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &memoryFilesystem{
+				files: map[string]*memoryFile{
+					filepath.Join(musicDirectory, "a.lrc"): &memoryFile{
+						ReadSeeker: strings.NewReader("[00:01.00]one\n[00:02.00]two\n"),
+					},
+				},
+			}
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = musicDirectory
+			values.Set("artist", tt.artist)
+			values.Set("title", tt.title)
+
+			withServer(t, db, fs, cfg, func(base string) {
+				c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/getLyrics.view", values))
+
+				if want, got := tt.value, c.Lyrics.Value; want != got {
+					t.Fatalf("unexpected lyrics:\n- want: %q\n-  got: %q", want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServer_getLyricsBySongId(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	db := &memoryDatabase{
+		files: []string{"a.mp3"},
+		attrs: map[string]mpd.Attrs{
+			"a.mp3": {"ARTIST": "Artist", "TITLE": "Title", "LYRICS": "plain"},
+		},
+	}
+
+	fs := &memoryFilesystem{
+		files: map[string]*memoryFile{
+			filepath.Join(musicDirectory, "a.lrc"): &memoryFile{
+				ReadSeeker: strings.NewReader("[offset:100]\n[00:00.00]one\n[00:02.50]two\n"),
+			},
+		},
+	}
+
+	cfg, values := configAuth()
+	cfg.MusicDirectory = musicDirectory
+	values.Set("id", "0")
+
+	withServer(t, db, fs, cfg, func(base string) {
+		c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/getLyricsBySongId.view", values))
+
+		start := func(ms int64) *int64 { return &ms }
+
+		want := []structuredLyrics{
+			{
+				DisplayArtist: "Artist",
+				DisplayTitle:  "Title",
+				Lang:          "xxx",
+				Offset:        100,
+				Synced:        true,
+				Lines: []lyricsLineElement{
+					{Start: start(0), Value: "one"},
+					{Start: start(2500), Value: "two"},
+				},
+			},
+			{
+				DisplayArtist: "Artist",
+				DisplayTitle:  "Title",
+				Lang:          "xxx",
+				Lines: []lyricsLineElement{
+					{Value: "plain"},
+				},
+			},
+		}
+
+		if got := c.LyricsList.StructuredLyrics; !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected lyrics:\n- want: %+v\n-  got: %+v", want, got)
+		}
+	})
+}
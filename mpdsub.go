@@ -5,6 +5,7 @@ package mpdsub
 import (
 	"io"
 	"os"
+	"path/filepath"
 
 	"github.com/fhs/gompd/mpd"
 )
@@ -15,14 +16,19 @@ var _ database = &mpd.Client{}
 // database queries.  database is implemented by *mpd.Client.
 type database interface {
 	List(args ...string) ([]string, error)
+	ListAllInfo(uri string) ([]mpd.Attrs, error)
+	ListPlaylists() ([]mpd.Attrs, error)
+	PlaylistContents(name string) ([]mpd.Attrs, error)
 	ReadComments(uri string) (mpd.Attrs, error)
+	Update(uri string) (int, error)
 	Ping() error
 }
 
-// A filesystem is a type which can open a file.  filesystem is implemented
-// by *osFilesystem.
+// A filesystem is a type which can open a file and resolve symbolic links.
+// filesystem is implemented by *osFilesystem.
 type filesystem interface {
 	Open(name string) (file, error)
+	EvalSymlinks(name string) (string, error)
 }
 
 var _ filesystem = &osFilesystem{}
@@ -31,11 +37,33 @@ var _ filesystem = &osFilesystem{}
 // filesystem.
 type osFilesystem struct{}
 
-// Open opens a file in the filesystem using os.Open.
+// Open opens a file in the filesystem using os.Open.  If the path traverses
+// an archive file, such as "album.zip/01.flac", the entry is opened from
+// within the archive.
 func (*osFilesystem) Open(name string) (file, error) {
+	if archive, entry, ok := findArchive(name); ok {
+		return openArchiveEntry(archive, entry)
+	}
+
 	return os.Open(name)
 }
 
+// EvalSymlinks resolves symbolic links in a path using filepath.EvalSymlinks.
+// If the path traverses an archive file, only the path of the archive is
+// resolved.
+func (*osFilesystem) EvalSymlinks(name string) (string, error) {
+	if archive, entry, ok := findArchive(name); ok {
+		p, err := filepath.EvalSymlinks(archive)
+		if err != nil {
+			return "", err
+		}
+
+		return filepath.Join(p, filepath.FromSlash(entry)), nil
+	}
+
+	return filepath.EvalSymlinks(name)
+}
+
 var _ file = &os.File{}
 
 // A file is a type which can be opened using a filesystem.  file is implemented
@@ -1,6 +1,8 @@
 package mpdsub
 
 import (
+	"context"
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io"
@@ -10,6 +12,9 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -27,6 +32,20 @@ func withServer(t *testing.T, db database, fs filesystem, cfg *Config, fn func(b
 			attrs: make(map[string]mpd.Attrs, 0),
 		}
 	}
+	if cfg == nil {
+		cfg = &Config{}
+	}
+
+	f := newFolder(0, "", db, cfg.MusicDirectory)
+	f.Mounts = cfg.Mounts
+
+	withFolders(t, []*folder{f}, fs, cfg, fn)
+}
+
+// withFolders creates a test Server using the input folders and configuration,
+// then invokes the input function with the base URL of the server passed as
+// a parameter.
+func withFolders(t *testing.T, folders []*folder, fs filesystem, cfg *Config, fn func(base string)) {
 	if fs == nil {
 		fs = &memoryFilesystem{
 			files: make(map[string]*memoryFile, 0),
@@ -38,7 +57,7 @@ func withServer(t *testing.T, db database, fs filesystem, cfg *Config, fn func(b
 	}
 	cfg.Logger = log.New(ioutil.Discard, "", 0)
 
-	s := httptest.NewServer(newServer(db, fs, cfg))
+	s := httptest.NewServer(newServer(folders, fs, cfg))
 	defer s.Close()
 
 	fn(s.URL)
@@ -68,9 +87,43 @@ func mustDecodeXML(t *testing.T, res *http.Response) container {
 		t.Fatalf("unexpected Subsonic API version:\n- want: %v\n-  got: %v", want, got)
 	}
 
+	if c.Type != serverType || c.ServerVersion != serverVersion || !c.OpenSubsonic {
+		t.Fatalf("unexpected OpenSubsonic attributes: %q, %q, %v",
+			c.Type, c.ServerVersion, c.OpenSubsonic)
+	}
+
 	return c
 }
 
+// mustDecodeJSON decodes a Subsonic JSON response from res.
+func mustDecodeJSON(t *testing.T, res *http.Response) container {
+	if want, got := http.StatusOK, res.StatusCode; want != got {
+		t.Fatalf("unexpected HTTP status code:\n- want: %03d\n-  got: %03d", want, got)
+	}
+
+	if want, got := contentTypeJSON, res.Header.Get(contentType); want != got {
+		t.Fatalf("unexpected response Content-Type:\n- want: %v\n-  got: %v", want, got)
+	}
+
+	var v struct {
+		Response container `json:"subsonic-response"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		t.Fatalf("failed to decode JSON: %v", err)
+	}
+	defer res.Body.Close()
+
+	if want, got := apiVersion, v.Response.Version; want != got {
+		t.Fatalf("unexpected Subsonic API version:\n- want: %v\n-  got: %v", want, got)
+	}
+
+	if !v.Response.OpenSubsonic {
+		t.Fatal("expected openSubsonic attribute to be set")
+	}
+
+	return v.Response
+}
+
 // testRequest performs a single HTTP request against the server specified by base, using the
 // input method, target URL, and query parameters.
 func testRequest(t *testing.T, base string, method string, target string, values url.Values) *http.Response {
@@ -94,6 +147,31 @@ func testRequest(t *testing.T, base string, method string, target string, values
 	return res
 }
 
+// testFormRequest performs a HTTP POST request to the test server, sending
+// query in the URL query string and form in an application/x-www-form-urlencoded
+// body.
+func testFormRequest(t *testing.T, base string, target string, query url.Values, form url.Values) *http.Response {
+	u, err := url.Parse(base)
+	if err != nil {
+		t.Fatalf("failed to parse test server URL: %v", err)
+	}
+	u.Path = target
+	u.RawQuery = query.Encode()
+
+	r, err := http.NewRequest(http.MethodPost, u.String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatalf("failed to create HTTP request: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := (&http.Client{}).Do(r)
+	if err != nil {
+		t.Fatalf("failed to perform HTTP request: %v", err)
+	}
+
+	return res
+}
+
 // configAuth returns a Config and url.Values that can be used to authenticate
 // successfully in tests.
 func configAuth() (*Config, url.Values) {
@@ -119,14 +197,38 @@ func configAuth() (*Config, url.Values) {
 	return cfg, values
 }
 
+// testUserRequest performs a GET request against target on the test server at
+// base, authenticating as a user whose password is the same as its name, and
+// decodes the XML response.  kv contains pairs of additional parameters.
+func testUserRequest(t *testing.T, base string, user string, target string, kv ...string) container {
+	v := url.Values{
+		"u": []string{user},
+		"p": []string{user},
+		"c": []string{"test"},
+		"v": []string{"1.14.0"},
+	}
+	for i := 0; i < len(kv); i += 2 {
+		v.Add(kv[i], kv[i+1])
+	}
+
+	return mustDecodeXML(t, testRequest(t, base, http.MethodGet, target, v))
+}
+
 var _ database = &memoryDatabase{}
 
 // A memoryDatabase is an in-memory implementation of database.
 type memoryDatabase struct {
 	files []string
 	attrs map[string]mpd.Attrs
+	info  map[string]mpd.Attrs
 	pingC chan<- struct{}
 
+	// Stored playlists, keyed by name.
+	playlists map[string][]mpd.Attrs
+
+	// URIs passed to Update, in order.
+	updates []string
+
 	mu sync.RWMutex
 }
 
@@ -141,11 +243,74 @@ func (db *memoryDatabase) List(args ...string) ([]string, error) {
 	return db.files, nil
 }
 
+func (db *memoryDatabase) ListAllInfo(uri string) ([]mpd.Attrs, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// The root URI lists information for every file
+	if uri == "" {
+		out := make([]mpd.Attrs, 0, len(db.files))
+		for _, f := range db.files {
+			attrs := mpd.Attrs{"file": f}
+			for k, v := range db.info[f] {
+				attrs[k] = v
+			}
+
+			out = append(out, attrs)
+		}
+
+		return out, nil
+	}
+
+	if attrs, ok := db.info[uri]; ok {
+		return []mpd.Attrs{attrs}, nil
+	}
+
+	return nil, fmt.Errorf("no MPD info for URI: %q", uri)
+}
+
+func (db *memoryDatabase) ListPlaylists() ([]mpd.Attrs, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	names := make([]string, 0, len(db.playlists))
+	for name := range db.playlists {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := make([]mpd.Attrs, 0, len(names))
+	for _, name := range names {
+		out = append(out, mpd.Attrs{"playlist": name})
+	}
+
+	return out, nil
+}
+
+func (db *memoryDatabase) PlaylistContents(name string) ([]mpd.Attrs, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if entries, ok := db.playlists[name]; ok {
+		return entries, nil
+	}
+
+	return nil, fmt.Errorf("no MPD playlist: %q", name)
+}
+
 func (db *memoryDatabase) Ping() error {
 	db.pingC <- struct{}{}
 	return nil
 }
 
+func (db *memoryDatabase) Update(uri string) (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.updates = append(db.updates, uri)
+	return len(db.updates), nil
+}
+
 func (db *memoryDatabase) ReadComments(uri string) (mpd.Attrs, error) {
 	db.mu.RLock()
 	defer db.mu.RUnlock()
@@ -162,6 +327,7 @@ var _ filesystem = &memoryFilesystem{}
 // A memoryFilesystem is an in-memory implementation of filesystem.
 type memoryFilesystem struct {
 	files map[string]*memoryFile
+	links map[string]string
 
 	mu sync.RWMutex
 }
@@ -177,6 +343,28 @@ func (fs *memoryFilesystem) Open(name string) (file, error) {
 	return nil, os.ErrNotExist
 }
 
+func (fs *memoryFilesystem) EvalSymlinks(name string) (string, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	// Resolve each element of the path in turn, so links in parent
+	// directories are also followed
+	var out string
+	for _, e := range strings.Split(filepath.Clean(name), string(os.PathSeparator)) {
+		if e == "" {
+			out = string(os.PathSeparator)
+			continue
+		}
+
+		out = filepath.Join(out, e)
+		if target, ok := fs.links[out]; ok {
+			out = target
+		}
+	}
+
+	return out, nil
+}
+
 // A memoryFile is an in-memory file used by memoryFilesystem.
 type memoryFile struct {
 	io.ReadSeeker
@@ -196,3 +384,84 @@ func (fi *memoryFileInfo) Mode() os.FileMode  { return 0 }
 func (fi *memoryFileInfo) ModTime() time.Time { return time.Now() }
 func (fi *memoryFileInfo) IsDir() bool        { return false }
 func (fi *memoryFileInfo) Sys() interface{}   { return nil }
+
+var _ Transcoder = &memoryTranscoder{}
+
+// A memoryTranscoder is a Transcoder which prefixes its input with the
+// requested options, rather than running a real encoder.
+type memoryTranscoder struct {
+	formats []string
+}
+
+func (t *memoryTranscoder) Supports(format string) bool {
+	for _, f := range t.formats {
+		if f == format {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *memoryTranscoder) Transcode(_ context.Context, r io.Reader, opts TranscodeOptions) (io.ReadCloser, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := fmt.Sprintf("%s:%d:%v:", opts.Format, opts.BitRate, opts.Offset.Seconds())
+	return ioutil.NopCloser(strings.NewReader(prefix + string(b))), nil
+}
+
+var _ Player = &memoryPlayer{}
+
+// A memoryPlayer is a Player which stores its queue in memory.
+type memoryPlayer struct {
+	mu    sync.Mutex
+	queue []string
+
+	// Counts the number of times the queue is cleared, the most recent
+	// position sought to, and whether the Player is playing.
+	clears  int
+	pos     int
+	time    int
+	playing bool
+}
+
+func (p *memoryPlayer) Clear() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue = nil
+	p.clears++
+	p.pos, p.time = -1, 0
+	p.playing = false
+	return nil
+}
+
+func (p *memoryPlayer) Add(uri string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.queue = append(p.queue, uri)
+	return nil
+}
+
+func (p *memoryPlayer) Seek(pos, time int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pos, p.time = pos, time
+	p.playing = true
+	return nil
+}
+
+func (p *memoryPlayer) Pause(pause bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.playing = !pause
+	return nil
+}
+
+func (p *memoryPlayer) Ping() error { return nil }
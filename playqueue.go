@@ -0,0 +1,260 @@
+package mpdsub
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A Player is a type which can replace the contents of an MPD queue.  Player
+// is implemented by *mpd.Client.
+type Player interface {
+	// Clear removes all items from the queue.
+	Clear() error
+
+	// Add appends the file with the input URI to the queue.
+	Add(uri string) error
+
+	// Seek begins playing the item at position pos in the queue, time
+	// seconds into it.
+	Seek(pos, time int) error
+
+	// Pause pauses or resumes playback.
+	Pause(pause bool) error
+
+	// Ping keeps the Player's connection alive.
+	Ping() error
+}
+
+// A playQueue is a queue of files saved by a user, along with the current
+// file and the position in milliseconds within it.
+type playQueue struct {
+	Entries   []fileRef `json:"entries"`
+	Current   *fileRef  `json:"current,omitempty"`
+	Position  int64     `json:"position"`
+	Changed   time.Time `json:"changed"`
+	ChangedBy string    `json:"changedBy"`
+}
+
+// getPlayQueue returns the requesting user's saved play queue.  Files which
+// no longer exist or which the user can no longer access are omitted.
+func (s *Server) getPlayQueue(w http.ResponseWriter, r *http.Request) {
+	u := requestUser(r)
+
+	var (
+		pq playQueue
+		ok bool
+	)
+	s.state.view(func(st *state) {
+		pq, ok = st.PlayQueues[u.Name]
+	})
+	if !ok {
+		// No saved play queue
+		writeXML(w, nil)
+		return
+	}
+
+	children, err := s.resolveRefs(u, pq.Entries)
+	if err != nil {
+		s.logf("error resolving files from mpd for getting play queue: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	entries := make([]child, 0, len(pq.Entries))
+	for _, ref := range pq.Entries {
+		if c, ok := children[ref]; ok {
+			entries = append(entries, c)
+		}
+	}
+
+	var current string
+	if pq.Current != nil {
+		if c, ok := children[*pq.Current]; ok {
+			current = c.ID
+		}
+	}
+
+	writeXML(w, func(c *container) {
+		c.PlayQueue = &playQueueContainer{
+			Current:   current,
+			Position:  pq.Position,
+			Username:  u.Name,
+			Changed:   pq.Changed,
+			ChangedBy: pq.ChangedBy,
+			Entries:   entries,
+		}
+	})
+}
+
+// savePlayQueue saves the requesting user's play queue, from one or more id
+// parameters, along with the current file and position within it.  If no id
+// parameters are present, the saved play queue is removed.  If a Player is
+// configured and the user has RoleJukebox, a play queue whose entries have
+// changed is also mirrored into the Player's queue.
+func (s *Server) savePlayQueue(w http.ResponseWriter, r *http.Request) {
+	u := requestUser(r)
+	qIDs := r.Form["id"]
+
+	var position int64
+	if qPosition := r.Form.Get("position"); qPosition != "" {
+		var err error
+		position, err = strconv.ParseInt(qPosition, 10, 64)
+		if err != nil || position < 0 {
+			writeXML(w, errGeneric)
+			return
+		}
+	}
+
+	// Resolve each ID to a reference, indexing each folder at most once
+	indexes := make(map[int][]indexedFile)
+	refs := make(map[string]fileRef, len(qIDs))
+	entries := make([]fileRef, 0, len(qIDs))
+	for _, qID := range qIDs {
+		ref, ok := refs[qID]
+		if !ok {
+			fid, id, err := parseID(qID)
+			if err != nil {
+				writeXML(w, errNotFound)
+				return
+			}
+
+			folder, ok := s.lookupFolder(fid)
+			if !ok {
+				writeXML(w, errNotFound)
+				return
+			}
+
+			files, ok := indexes[folder.ID]
+			if !ok {
+				files, err = folder.index()
+				if err != nil {
+					s.logf("error listing files from mpd for saving play queue: %v", err)
+					writeXML(w, errGeneric)
+					return
+				}
+
+				indexes[folder.ID] = files
+			}
+
+			file, ok := lookupFile(u, files, id)
+			if !ok || file.Dir {
+				writeXML(w, errNotFound)
+				return
+			}
+
+			ref = fileRef{Folder: folder.ID, Name: file.Name}
+			refs[qID] = ref
+		}
+
+		entries = append(entries, ref)
+	}
+
+	// The current file must be one of the files in the queue
+	var current *fileRef
+	if qCurrent := r.Form.Get("current"); qCurrent != "" && len(entries) > 0 {
+		ref, ok := refs[qCurrent]
+		if !ok {
+			writeXML(w, errNotFound)
+			return
+		}
+
+		current = &ref
+	}
+
+	// Clients save their play queue frequently to record the position within
+	// the current file, so track whether the entries themselves have changed
+	var changed bool
+	err := s.state.update(func(st *state) {
+		changed = !equalRefs(st.PlayQueues[u.Name].Entries, entries)
+
+		if len(entries) == 0 {
+			delete(st.PlayQueues, u.Name)
+			return
+		}
+
+		if st.PlayQueues == nil {
+			st.PlayQueues = make(map[string]playQueue)
+		}
+
+		st.PlayQueues[u.Name] = playQueue{
+			Entries:   entries,
+			Current:   current,
+			Position:  position,
+			Changed:   time.Now(),
+			ChangedBy: r.Form.Get("c"),
+		}
+	})
+	if err != nil {
+		s.logf("error saving play queue: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	if s.cfg.Player != nil && u.can(RoleJukebox) && changed {
+		if err := s.mirrorPlayQueue(entries, current, position); err != nil {
+			// The play queue was saved, so only log the failure
+			s.logf("error mirroring play queue to mpd: %v", err)
+		}
+	}
+
+	writeXML(w, nil)
+}
+
+// mirrorPlayQueue replaces the Player's queue with the entries of a play
+// queue, and seeks to position milliseconds into the current file, if any.
+// Playback is left paused, so that it only continues on MPD's outputs when
+// someone chooses to continue it there.
+// Only files from the first music folder are added, because the Player refers
+// to files using that folder's MPD database.
+func (s *Server) mirrorPlayQueue(entries []fileRef, current *fileRef, position int64) error {
+	s.playerMu.Lock()
+	defer s.playerMu.Unlock()
+
+	if err := s.cfg.Player.Clear(); err != nil {
+		return err
+	}
+
+	pos := -1
+	var n int
+	for _, ref := range entries {
+		if ref.Folder != 0 {
+			continue
+		}
+
+		if err := s.cfg.Player.Add(ref.Name); err != nil {
+			return err
+		}
+
+		if current != nil && pos == -1 && ref == *current {
+			pos = n
+		}
+		n++
+	}
+
+	if pos == -1 {
+		return nil
+	}
+
+	// MPD can only seek by starting playback, so pause immediately
+	if err := s.cfg.Player.Seek(pos, int(position/1000)); err != nil {
+		return err
+	}
+
+	return s.cfg.Player.Pause(true)
+}
+
+// equalRefs determines if a and b refer to the same files, in the same order.
+func equalRefs(a, b []fileRef) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,122 @@
+package mpdsub
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+func TestServerPlayQueue(t *testing.T) {
+	db := &memoryDatabase{
+		files: []string{"a.mp3", "b.mp3"},
+		attrs: map[string]mpd.Attrs{
+			"a.mp3": {"TITLE": "A"},
+			"b.mp3": {"TITLE": "B"},
+		},
+	}
+
+	p := &memoryPlayer{}
+
+	cfg := &Config{
+		Users: []User{
+			{Name: "test", Password: "test", Roles: RoleJukebox},
+			{Name: "user", Password: "user", Roles: RoleStream},
+		},
+		Player: p,
+	}
+
+	request := func(base string, target string, kv ...string) container {
+		return testUserRequest(t, base, "test", target, kv...)
+	}
+
+	withServer(t, db, nil, cfg, func(base string) {
+		if c := request(base, "/rest/getPlayQueue.view"); c.PlayQueue != nil {
+			t.Fatalf("unexpected play queue before saving: %+v", c.PlayQueue)
+		}
+
+		errTests := []struct {
+			name string
+			kv   []string
+			code int
+		}{
+			{
+				name: "not found",
+				kv:   []string{"id", "9"},
+				code: codeNotFound,
+			},
+			{
+				name: "current not in queue",
+				kv:   []string{"id", "0", "current", "1"},
+				code: codeNotFound,
+			},
+			{
+				name: "bad position",
+				kv:   []string{"id", "0", "position", "foo"},
+				code: codeGeneric,
+			},
+		}
+
+		for _, tt := range errTests {
+			c := request(base, "/rest/savePlayQueue.view", tt.kv...)
+			if want, got := tt.code, c.Error.Code; want != got {
+				t.Fatalf("%s: unexpected error code:\n- want: %v\n-  got: %v", tt.name, want, got)
+			}
+		}
+
+		// Users without RoleJukebox may save a play queue, but it is not
+		// mirrored to the Player
+		testUserRequest(t, base, "user", "/rest/savePlayQueue.view", "id", "0")
+		if p.clears != 0 {
+			t.Fatalf("unexpected player queue for user without jukebox role: %v", p.queue)
+		}
+
+		c := request(base, "/rest/savePlayQueue.view",
+			"id", "1", "id", "0", "current", "0", "position", "2500")
+		if want, got := statusOK, c.Status; want != got {
+			t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+		}
+
+		if want, got := []string{"b.mp3", "a.mp3"}, p.queue; !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected player queue:\n- want: %v\n-  got: %v", want, got)
+		}
+		if p.pos != 1 || p.time != 2 {
+			t.Fatalf("unexpected player position: %d, %ds", p.pos, p.time)
+		}
+		if p.playing {
+			t.Fatal("mirroring a play queue must not start playback")
+		}
+
+		// Saving the same entries with a new position does not interrupt
+		// the Player
+		request(base, "/rest/savePlayQueue.view",
+			"id", "1", "id", "0", "current", "0", "position", "5000")
+		if want, got := 1, p.clears; want != got {
+			t.Fatalf("unexpected number of player queue clears:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		pq := request(base, "/rest/getPlayQueue.view").PlayQueue
+		if pq == nil {
+			t.Fatal("expected a saved play queue")
+		}
+
+		if pq.Current != "0" || pq.Position != 5000 || pq.Username != "test" || pq.ChangedBy != "test" {
+			t.Fatalf("unexpected play queue: %+v", pq)
+		}
+
+		var titles []string
+		for _, e := range pq.Entries {
+			titles = append(titles, e.Title)
+		}
+
+		if want, got := []string{"B", "A"}, titles; !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected play queue entries:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		// Saving without any IDs removes the play queue
+		request(base, "/rest/savePlayQueue.view")
+		if c := request(base, "/rest/getPlayQueue.view"); c.PlayQueue != nil {
+			t.Fatalf("unexpected play queue after clearing: %+v", c.PlayQueue)
+		}
+	})
+}
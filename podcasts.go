@@ -0,0 +1,719 @@
+package mpdsub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Possible statuses of podcast channels and episodes.
+const (
+	podcastNew         = "new"
+	podcastDownloading = "downloading"
+	podcastCompleted   = "completed"
+	podcastError       = "error"
+	podcastDeleted     = "deleted"
+	podcastSkipped     = "skipped"
+)
+
+// A podcastChannel is a podcast feed which the Server is subscribed to.
+type podcastChannel struct {
+	ID          int              `json:"id"`
+	URL         string           `json:"url"`
+	Title       string           `json:"title"`
+	Description string           `json:"description,omitempty"`
+	ImageURL    string           `json:"imageUrl,omitempty"`
+	Status      string           `json:"status"`
+	Error       string           `json:"error,omitempty"`
+	Episodes    []podcastEpisode `json:"episodes,omitempty"`
+}
+
+// A podcastEpisode is a single episode of a podcastChannel.  Once downloaded,
+// File is the episode's name relative to the music directory.
+type podcastEpisode struct {
+	ID          int       `json:"id"`
+	GUID        string    `json:"guid"`
+	Title       string    `json:"title"`
+	Description string    `json:"description,omitempty"`
+	Published   time.Time `json:"published"`
+	URL         string    `json:"url,omitempty"`
+	ContentType string    `json:"contentType,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	File        string    `json:"file,omitempty"`
+}
+
+// key returns the key used to match an episode with a feedItem when a
+// channel is refreshed.
+func (e podcastEpisode) key() string {
+	if e.GUID != "" {
+		return e.GUID
+	}
+
+	return e.URL
+}
+
+// merge merges the contents of a feed into the channel.  Episodes which are
+// not yet present in the channel are added, using nextID to assign their IDs.
+func (c *podcastChannel) merge(f feed, nextID func() int) {
+	if f.Title != "" {
+		c.Title = f.Title
+	}
+	c.Description = f.Description
+	c.ImageURL = f.ImageURL
+
+	seen := make(map[string]bool, len(c.Episodes))
+	for _, e := range c.Episodes {
+		seen[e.key()] = true
+	}
+
+	for _, it := range f.Items {
+		e := podcastEpisode{
+			GUID:        it.GUID,
+			Title:       it.Title,
+			Description: it.Description,
+			Published:   it.Published,
+			URL:         it.URL,
+			ContentType: it.ContentType,
+			Size:        it.Size,
+			Status:      podcastNew,
+		}
+		if seen[e.key()] {
+			continue
+		}
+		seen[e.key()] = true
+
+		// Episodes without an enclosure cannot be downloaded
+		if e.URL == "" {
+			e.Status = podcastSkipped
+		}
+
+		e.ID = nextID()
+		c.Episodes = append(c.Episodes, e)
+	}
+}
+
+// podcastDirectory returns the absolute path of the directory into which
+// podcast episodes are downloaded.  It returns false if podcasts are not
+// enabled, or if the directory is not within the music directory.
+func (s *Server) podcastDirectory() (string, bool) {
+	if s.cfg.PodcastDirectory == "" || s.folders[0].Dir == "" {
+		return "", false
+	}
+
+	root := s.folders[0].Dir
+	dir := filepath.Join(root, s.cfg.PodcastDirectory)
+	if filepath.IsAbs(s.cfg.PodcastDirectory) || dir == root || !within(root, dir) {
+		return "", false
+	}
+
+	return dir, true
+}
+
+// requirePodcasts is a middleware which only invokes fn if podcasts are
+// enabled for the Server.  Otherwise, a not found error is returned, since
+// the user is authorized but no podcast data exists.
+func (s *Server) requirePodcasts(fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := s.podcastDirectory(); !ok {
+			writeXML(w, errPodcastsNotConfigured)
+			return
+		}
+
+		fn(w, r)
+	}
+}
+
+// fetchFeed retrieves and parses the podcast feed at the input URL.
+func (s *Server) fetchFeed(ctx context.Context, u string) (feed, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return feed{}, err
+	}
+
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return feed{}, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return feed{}, fmt.Errorf("unexpected HTTP status for podcast feed: %d", res.StatusCode)
+	}
+
+	return parseFeed(res.Body)
+}
+
+// refreshChannel fetches the feed for the channel with the input ID and URL,
+// and merges it into the stored channel.
+func (s *Server) refreshChannel(ctx context.Context, id int, u string) error {
+	f, err := s.fetchFeed(ctx, u)
+
+	return s.state.update(func(st *state) {
+		c := st.podcastChannel(id)
+		if c == nil {
+			// Channel was deleted while its feed was being fetched
+			return
+		}
+
+		if err != nil {
+			c.Status = podcastError
+			c.Error = err.Error()
+			return
+		}
+
+		c.Status = podcastCompleted
+		c.Error = ""
+		c.merge(f, st.nextPodcastID)
+	})
+}
+
+// podcastChannel returns the channel with the input ID, or nil if none
+// exists.
+func (st *state) podcastChannel(id int) *podcastChannel {
+	for i := range st.Podcasts {
+		if st.Podcasts[i].ID == id {
+			return &st.Podcasts[i]
+		}
+	}
+
+	return nil
+}
+
+// podcastEpisode returns the episode with the input ID and its channel, or
+// nil if none exists.
+func (st *state) podcastEpisode(id int) (*podcastChannel, *podcastEpisode) {
+	for i := range st.Podcasts {
+		c := &st.Podcasts[i]
+		for j := range c.Episodes {
+			if c.Episodes[j].ID == id {
+				return c, &c.Episodes[j]
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// nextPodcastID assigns an ID to a new podcast channel or episode.
+func (st *state) nextPodcastID() int {
+	st.NextPodcastID++
+	return st.NextPodcastID
+}
+
+// getPodcasts returns the podcast channels the Server is subscribed to,
+// optionally filtered by the id parameter.  Episodes are included unless the
+// includeEpisodes parameter is false.
+func (s *Server) getPodcasts(w http.ResponseWriter, r *http.Request) {
+	includeEpisodes := r.Form.Get("includeEpisodes") != "false"
+
+	id := -1
+	if qID := r.Form.Get("id"); qID != "" {
+		var err error
+		if id, err = strconv.Atoi(qID); err != nil {
+			writeXML(w, errNotFound)
+			return
+		}
+	}
+
+	var channels []podcastChannel
+	s.state.view(func(st *state) {
+		for _, c := range st.Podcasts {
+			if id != -1 && c.ID != id {
+				continue
+			}
+
+			c.Episodes = append([]podcastEpisode(nil), c.Episodes...)
+			channels = append(channels, c)
+		}
+	})
+	if id != -1 && len(channels) == 0 {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	var (
+		files []indexedFile
+		err   error
+	)
+	if includeEpisodes {
+		if files, err = s.folders[0].index(); err != nil {
+			s.logf("error listing files from mpd for getting podcasts: %v", err)
+			writeXML(w, errGeneric)
+			return
+		}
+	}
+
+	u := requestUser(r)
+	out := make([]podcastChannelElement, 0, len(channels))
+	for _, c := range channels {
+		ce := podcastChannelElement{
+			ID:               strconv.Itoa(c.ID),
+			URL:              c.URL,
+			Title:            c.Title,
+			Description:      c.Description,
+			OriginalImageURL: c.ImageURL,
+			Status:           c.Status,
+			ErrorMessage:     c.Error,
+		}
+
+		if includeEpisodes {
+			for _, e := range c.Episodes {
+				ce.Episodes = append(ce.Episodes, newPodcastEpisodeElement(u, files, c, e))
+			}
+		}
+
+		out = append(out, ce)
+	}
+
+	writeXML(w, func(c *container) {
+		c.Podcasts = &podcastsContainer{
+			Channels: out,
+		}
+	})
+}
+
+// getNewestPodcasts returns the most recently published podcast episodes,
+// up to the count parameter.
+func (s *Server) getNewestPodcasts(w http.ResponseWriter, r *http.Request) {
+	count := 20
+	if qCount := r.Form.Get("count"); qCount != "" {
+		var err error
+		if count, err = strconv.Atoi(qCount); err != nil || count < 0 {
+			writeXML(w, errGeneric)
+			return
+		}
+	}
+
+	type channelEpisode struct {
+		c podcastChannel
+		e podcastEpisode
+	}
+
+	var episodes []channelEpisode
+	s.state.view(func(st *state) {
+		for _, c := range st.Podcasts {
+			for _, e := range c.Episodes {
+				if e.Status == podcastDeleted || e.Status == podcastSkipped {
+					continue
+				}
+
+				episodes = append(episodes, channelEpisode{c: c, e: e})
+			}
+		}
+	})
+
+	sort.SliceStable(episodes, func(i, j int) bool {
+		return episodes[i].e.Published.After(episodes[j].e.Published)
+	})
+	if len(episodes) > count {
+		episodes = episodes[:count]
+	}
+
+	files, err := s.folders[0].index()
+	if err != nil {
+		s.logf("error listing files from mpd for getting newest podcasts: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	u := requestUser(r)
+	out := make([]podcastEpisodeElement, 0, len(episodes))
+	for _, ce := range episodes {
+		out = append(out, newPodcastEpisodeElement(u, files, ce.c, ce.e))
+	}
+
+	writeXML(w, func(c *container) {
+		c.NewestPodcasts = &newestPodcastsContainer{
+			Episodes: out,
+		}
+	})
+}
+
+// newPodcastEpisodeElement creates a podcastEpisodeElement for an episode of
+// channel c.  If the episode has been downloaded and indexed by MPD, its
+// stream ID refers to the downloaded file.
+func newPodcastEpisodeElement(u *User, files []indexedFile, c podcastChannel, e podcastEpisode) podcastEpisodeElement {
+	pe := podcastEpisodeElement{
+		ID:          strconv.Itoa(e.ID),
+		ChannelID:   strconv.Itoa(c.ID),
+		Title:       e.Title,
+		Description: e.Description,
+		Status:      e.Status,
+		ContentType: e.ContentType,
+		Size:        e.Size,
+	}
+	if !e.Published.IsZero() {
+		pe.PublishDate = e.Published.UTC().Format(time.RFC3339)
+	}
+
+	if e.File != "" {
+		pe.Suffix = strings.TrimPrefix(path.Ext(e.File), ".")
+		if f, ok := findFile(u, files, e.File); ok {
+			pe.StreamID = formatID(0, f.ID)
+		}
+	}
+
+	return pe
+}
+
+// createPodcastChannel subscribes to the podcast feed at the url parameter.
+// If the feed cannot be retrieved, the channel is still created, with an
+// error status.
+func (s *Server) createPodcastChannel(w http.ResponseWriter, r *http.Request) {
+	u := r.Form.Get("url")
+	if u == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+	if !isRemoteURI(u) {
+		writeXML(w, errGeneric)
+		return
+	}
+
+	var id int
+	err := s.state.update(func(st *state) {
+		id = st.nextPodcastID()
+		st.Podcasts = append(st.Podcasts, podcastChannel{
+			ID:     id,
+			URL:    u,
+			Title:  u,
+			Status: podcastNew,
+		})
+	})
+	if err != nil {
+		s.logf("error creating podcast channel: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	if err := s.refreshChannel(r.Context(), id, u); err != nil {
+		s.logf("error refreshing podcast channel: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	writeXML(w, nil)
+}
+
+// refreshPodcasts fetches the feed of each podcast channel, adding any new
+// episodes.
+func (s *Server) refreshPodcasts(w http.ResponseWriter, r *http.Request) {
+	var channels []podcastChannel
+	s.state.view(func(st *state) {
+		channels = append(channels, st.Podcasts...)
+	})
+
+	for _, c := range channels {
+		if err := s.refreshChannel(r.Context(), c.ID, c.URL); err != nil {
+			s.logf("error refreshing podcast channel: %v", err)
+			writeXML(w, errGeneric)
+			return
+		}
+	}
+
+	writeXML(w, nil)
+}
+
+// downloadPodcastEpisode begins downloading a podcast episode into the
+// podcast directory.  The download continues in the background, and the
+// episode's status indicates when it is complete.
+func (s *Server) downloadPodcastEpisode(w http.ResponseWriter, r *http.Request) {
+	id, ok := podcastEpisodeID(w, r)
+	if !ok {
+		return
+	}
+
+	var (
+		c            podcastChannel
+		e            podcastEpisode
+		found, start bool
+	)
+	err := s.state.update(func(st *state) {
+		pc, pe := st.podcastEpisode(id)
+		if pe == nil || pe.URL == "" {
+			return
+		}
+		found = true
+
+		// Episodes which are already downloaded or downloading are left alone
+		if pe.Status == podcastDownloading || pe.Status == podcastCompleted {
+			return
+		}
+
+		pe.Status = podcastDownloading
+		pe.Error = ""
+
+		c, e = *pc, *pe
+		start = true
+	})
+	if err != nil {
+		s.logf("error downloading podcast episode: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+	if !found {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	if start {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.downloadEpisode(c, e)
+		}()
+	}
+
+	writeXML(w, nil)
+}
+
+// downloadEpisode downloads episode e of channel c into the podcast directory,
+// then asks MPD to index it.  The episode's status is updated when the
+// download completes or fails.
+func (s *Server) downloadEpisode(c podcastChannel, e podcastEpisode) {
+	name, err := s.fetchEpisode(c, e)
+
+	err = s.state.update(func(st *state) {
+		_, pe := st.podcastEpisode(e.ID)
+		if pe == nil {
+			return
+		}
+
+		if err != nil {
+			pe.Status = podcastError
+			pe.Error = err.Error()
+			return
+		}
+
+		pe.Status = podcastCompleted
+		pe.File = name
+	})
+	if err != nil {
+		s.logf("error saving podcast episode %d: %v", e.ID, err)
+		return
+	}
+
+	s.updatePodcasts()
+}
+
+// fetchEpisode downloads episode e of channel c into the podcast directory,
+// and returns the name of the downloaded file relative to the music directory.
+func (s *Server) fetchEpisode(c podcastChannel, e podcastEpisode) (string, error) {
+	dir, ok := s.podcastDirectory()
+	if !ok {
+		return "", fmt.Errorf("podcasts are not enabled")
+	}
+
+	req, err := http.NewRequest(http.MethodGet, e.URL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	res, err := s.client.Do(req.WithContext(s.ctx))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected HTTP status for podcast episode: %d", res.StatusCode)
+	}
+
+	cdir := filepath.Join(dir, sanitizeName(c.Title, "channel-"+strconv.Itoa(c.ID)))
+	if err := os.MkdirAll(cdir, 0755); err != nil {
+		return "", err
+	}
+
+	ext := episodeExt(e.URL, res.Header.Get("Content-Type"))
+	base := sanitizeName(e.Title, "episode-"+strconv.Itoa(e.ID))
+
+	// Reserve the episode's file name before downloading, so that concurrent
+	// downloads of episodes with the same title cannot overwrite each other
+	p, err := reserveFile(
+		filepath.Join(cdir, base+ext),
+		// Another episode has the same title
+		filepath.Join(cdir, fmt.Sprintf("%s (%d)%s", base, e.ID, ext)),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	// Download to a temporary file so MPD never indexes a partial episode
+	f, err := ioutil.TempFile(cdir, ".download")
+	if err != nil {
+		_ = os.Remove(p)
+		return "", err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, res.Body); err != nil {
+		_ = f.Close()
+		_ = os.Remove(p)
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(p)
+		return "", err
+	}
+	if err := os.Rename(f.Name(), p); err != nil {
+		_ = os.Remove(p)
+		return "", err
+	}
+
+	rel, err := filepath.Rel(s.folders[0].Dir, p)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.ToSlash(rel), nil
+}
+
+// reserveFile atomically creates an empty file at the first of paths which
+// does not already exist, and returns its path.
+func reserveFile(paths ...string) (string, error) {
+	var err error
+	for _, p := range paths {
+		var f *os.File
+		f, err = os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		return p, f.Close()
+	}
+
+	return "", err
+}
+
+// updatePodcasts asks MPD to update its database for the podcast directory.
+func (s *Server) updatePodcasts() {
+	uri := filepath.ToSlash(filepath.Clean(s.cfg.PodcastDirectory))
+	if _, err := s.folders[0].db.Update(uri); err != nil {
+		s.logf("error updating mpd database for podcasts: %v", err)
+	}
+}
+
+// deletePodcastEpisode deletes a downloaded podcast episode.  The episode is
+// kept with a deleted status, so that it is not added again when its channel
+// is refreshed.
+func (s *Server) deletePodcastEpisode(w http.ResponseWriter, r *http.Request) {
+	id, ok := podcastEpisodeID(w, r)
+	if !ok {
+		return
+	}
+
+	var (
+		name  string
+		found bool
+	)
+	err := s.state.update(func(st *state) {
+		_, pe := st.podcastEpisode(id)
+		if pe == nil {
+			return
+		}
+		found = true
+
+		name = pe.File
+		pe.File = ""
+		pe.Status = podcastDeleted
+	})
+	if err != nil {
+		s.logf("error deleting podcast episode: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+	if !found {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	if name != "" {
+		p := filepath.Join(s.folders[0].Dir, filepath.FromSlash(name))
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			s.logf("error removing podcast episode %q: %v", name, err)
+			writeXML(w, errGeneric)
+			return
+		}
+
+		s.updatePodcasts()
+	}
+
+	writeXML(w, nil)
+}
+
+// podcastEpisodeID parses the ID of a podcast episode from a request.  If
+// the ID is missing or invalid, an error is written to w and podcastEpisodeID
+// returns false.
+func podcastEpisodeID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(qID)
+	if err != nil {
+		writeXML(w, errNotFound)
+		return 0, false
+	}
+
+	return id, true
+}
+
+// sanitizeName produces a file name from s which is safe to use within a
+// directory.  If nothing remains of s, fallback is returned.
+func sanitizeName(s string, fallback string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), strings.ContainsRune(" -_.,()&'", r):
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+
+	// Leading dots would create hidden files, or refer to parent directories
+	s = strings.TrimLeft(strings.TrimSpace(s), ".")
+	if s == "" {
+		return fallback
+	}
+
+	return s
+}
+
+// episodeExt determines the file extension for an episode downloaded from
+// the input URL, with the input Content-Type.
+func episodeExt(u string, contentType string) string {
+	if i := strings.IndexAny(u, "?#"); i != -1 {
+		u = u[:i]
+	}
+
+	ext := path.Ext(u)
+	if len(ext) > 1 && len(ext) <= 5 && sanitizeName(ext[1:], "") == ext[1:] {
+		return strings.ToLower(ext)
+	}
+
+	if t, _, err := mime.ParseMediaType(contentType); err == nil {
+		if exts, _ := mime.ExtensionsByType(t); len(exts) > 0 {
+			return exts[0]
+		}
+	}
+
+	return ".mp3"
+}
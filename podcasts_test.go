@@ -0,0 +1,189 @@
+package mpdsub
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServerPodcasts(t *testing.T) {
+	musicDirectory, err := ioutil.TempDir("", "mpdsub-podcasts")
+	if err != nil {
+		t.Fatalf("failed to create music directory: %v", err)
+	}
+	defer os.RemoveAll(musicDirectory)
+
+	var episodes int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/feed.xml", func(w http.ResponseWriter, r *http.Request) {
+		// Each fetch of the feed publishes one more episode
+		episodes++
+
+		fmt.Fprint(w, `<rss><channel><title>Show</title>`)
+		for i := 1; i <= episodes; i++ {
+			fmt.Fprintf(w, `<item><guid>%d</guid><title>Episode %d</title><pubDate>Mon, 0%d Jan 2018 00:00:00 +0000</pubDate>`, i, i, i)
+			fmt.Fprintf(w, `<enclosure url="http://%s/%d.mp3" type="audio/mpeg"/></item>`, r.Host, i)
+		}
+		fmt.Fprint(w, `</channel></rss>`)
+	})
+	mux.HandleFunc("/1.mp3", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("episode 1"))
+	})
+
+	feed := httptest.NewServer(mux)
+	defer feed.Close()
+
+	db := &memoryDatabase{}
+
+	cfg := &Config{
+		MusicDirectory:   musicDirectory,
+		PodcastDirectory: "podcasts",
+		Users: []User{
+			{Name: "admin", Password: "admin", Roles: RoleAdmin},
+			{Name: "user", Password: "user", Roles: RoleStream},
+		},
+	}
+
+	withServer(t, db, nil, cfg, func(base string) {
+		mustOK := func(c container) {
+			if c.Error != nil {
+				t.Fatalf("unexpected error: %+v", c.Error)
+			}
+		}
+
+		c := testUserRequest(t, base, "user", "/rest/createPodcastChannel.view", "url", feed.URL+"/feed.xml")
+		if want, got := codeNotAuthorized, c.Error.Code; want != got {
+			t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		mustOK(testUserRequest(t, base, "admin", "/rest/createPodcastChannel.view", "url", feed.URL+"/feed.xml"))
+		mustOK(testUserRequest(t, base, "admin", "/rest/refreshPodcasts.view"))
+
+		c = testUserRequest(t, base, "user", "/rest/getPodcasts.view")
+		if want, got := 1, len(c.Podcasts.Channels); want != got {
+			t.Fatalf("unexpected number of channels:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		ch := c.Podcasts.Channels[0]
+		if want, got := "Show", ch.Title; want != got {
+			t.Fatalf("unexpected channel title:\n- want: %q\n-  got: %q", want, got)
+		}
+		if want, got := 2, len(ch.Episodes); want != got {
+			t.Fatalf("unexpected number of episodes:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		c = testUserRequest(t, base, "user", "/rest/getPodcasts.view", "includeEpisodes", "false")
+		if want, got := 0, len(c.Podcasts.Channels[0].Episodes); want != got {
+			t.Fatalf("unexpected number of episodes:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		c = testUserRequest(t, base, "user", "/rest/getNewestPodcasts.view", "count", "1")
+		if want, got := []string{"Episode 2"}, episodeTitles(c.NewestPodcasts.Episodes); !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected newest episodes:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		id := ch.Episodes[0].ID
+		mustOK(testUserRequest(t, base, "admin", "/rest/downloadPodcastEpisode.view", "id", id))
+
+		// Wait for the background download to complete
+		var e podcastEpisodeElement
+		for i := 0; ; i++ {
+			c = testUserRequest(t, base, "user", "/rest/getPodcasts.view")
+			e = c.Podcasts.Channels[0].Episodes[0]
+			if e.Status != podcastDownloading {
+				break
+			}
+			if i == 100 {
+				t.Fatal("timed out waiting for episode download")
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+		if want, got := podcastCompleted, e.Status; want != got {
+			t.Fatalf("unexpected episode status:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		p := filepath.Join(musicDirectory, "podcasts", "Show", "Episode 1.mp3")
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Fatalf("failed to read downloaded episode: %v", err)
+		}
+		if want, got := "episode 1", string(b); want != got {
+			t.Fatalf("unexpected episode contents:\n- want: %q\n-  got: %q", want, got)
+		}
+
+		mustOK(testUserRequest(t, base, "admin", "/rest/deletePodcastEpisode.view", "id", id))
+
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Fatalf("expected episode to be removed, but got: %v", err)
+		}
+
+		c = testUserRequest(t, base, "user", "/rest/getPodcasts.view")
+		if want, got := podcastDeleted, c.Podcasts.Channels[0].Episodes[0].Status; want != got {
+			t.Fatalf("unexpected episode status:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+
+		if want, got := []string{"podcasts", "podcasts"}, db.updates; !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected database updates:\n- want: %v\n-  got: %v", want, got)
+		}
+	})
+}
+
+func TestServerPodcastsDisabled(t *testing.T) {
+	cfg, values := configAuth()
+	values.Set("url", "http://example.com/feed.xml")
+
+	withServer(t, nil, nil, cfg, func(base string) {
+		c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/createPodcastChannel.view", values))
+
+		if want, got := codeNotFound, c.Error.Code; want != got {
+			t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+		}
+	})
+}
+
+func episodeTitles(es []podcastEpisodeElement) []string {
+	var out []string
+	for _, e := range es {
+		out = append(out, e.Title)
+	}
+
+	return out
+}
+
+func Test_reserveFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mpdsub-reserve")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		a = filepath.Join(dir, "Episode.mp3")
+		b = filepath.Join(dir, "Episode (2).mp3")
+	)
+
+	for _, want := range []string{a, b} {
+		got, err := reserveFile(a, b)
+		if err != nil {
+			t.Fatalf("failed to reserve file: %v", err)
+		}
+
+		if want != got {
+			t.Fatalf("unexpected reserved file:\n- want: %q\n-  got: %q", want, got)
+		}
+	}
+
+	if _, err := reserveFile(a, b); !os.IsExist(err) {
+		t.Fatalf("expected file exists error, but got: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package mpdsub
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// isRemoteURI determines if an MPD URI refers to a remote resource, such as
+// an internet radio stream, rather than a file in the music directory.
+func isRemoteURI(uri string) bool {
+	return strings.HasPrefix(uri, "http://") || strings.HasPrefix(uri, "https://")
+}
+
+// remoteURL returns the HTTP URL of the file with the input name, if it is
+// not stored in the folder's music directory.  Files are remote if their name
+// is an HTTP URI, or if they are beneath one of the folder's storage mounts.
+// A file beneath a mount whose name escapes the mount's base URL is remote,
+// but has no URL.
+func (f *folder) remoteURL(name string) (string, bool) {
+	if isRemoteURI(name) {
+		return name, true
+	}
+
+	elems := strings.SplitN(name, string(os.PathSeparator), 2)
+	if len(elems) != 2 {
+		return "", false
+	}
+
+	base, ok := f.Mounts[elems[0]]
+	if !ok {
+		return "", false
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", false
+	}
+
+	// As with local files, names must not climb above the mount
+	root := path.Clean("/" + u.Path)
+	p := path.Join(root, filepath.ToSlash(elems[1]))
+	if p != root && !strings.HasPrefix(p, strings.TrimSuffix(root, "/")+"/") {
+		return "", true
+	}
+
+	u.Path = p
+	return u.String(), true
+}
+
+// remoteName returns the file name of the resource at the input URL, without
+// its query string or escaping, for use as a downloaded file's name.
+func remoteName(u string) string {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "download"
+	}
+
+	name := path.Base(pu.Path)
+	if name == "/" || name == "." {
+		return "download"
+	}
+
+	return name
+}
+
+// proxyRequestHeaders and proxyResponseHeaders are the HTTP headers which are
+// passed between a client and an upstream server by proxy, so that range
+// requests and caching work.
+var (
+	proxyRequestHeaders = []string{
+		"Range",
+		"If-Range",
+		"If-Modified-Since",
+		"If-None-Match",
+	}
+
+	proxyResponseHeaders = []string{
+		"Accept-Ranges",
+		"Content-Length",
+		"Content-Range",
+		"Content-Type",
+		"ETag",
+		"Last-Modified",
+	}
+)
+
+// proxy streams the resource at the input URL to a client.  Range requests
+// are passed through to the upstream server, which may or may not honor them.
+func (s *Server) proxy(w http.ResponseWriter, r *http.Request, u string) {
+	if u == "" {
+		// Name escaped its storage mount
+		writeXML(w, errNotFound)
+		return
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		s.logf("error creating proxy request for %q: %v", u, err)
+		writeXML(w, errGeneric)
+		return
+	}
+	req = req.WithContext(r.Context())
+
+	for _, h := range proxyRequestHeaders {
+		if v := r.Header.Get(h); v != "" {
+			req.Header.Set(h, v)
+		}
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		s.logf("error performing proxy request for %q: %v", u, err)
+		writeXML(w, errGeneric)
+		return
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		writeXML(w, errNotFound)
+		return
+	case res.StatusCode >= 400 && res.StatusCode != http.StatusRequestedRangeNotSatisfiable:
+		s.logf("unexpected HTTP status from proxy request for %q: %d", u, res.StatusCode)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	for _, h := range proxyResponseHeaders {
+		if v := res.Header.Get(h); v != "" {
+			w.Header().Set(h, v)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+
+	if _, err := io.Copy(w, res.Body); err != nil && s.cfg.Verbose {
+		s.logf("error copying proxied stream: %v", err)
+	}
+}
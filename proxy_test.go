@@ -0,0 +1,300 @@
+package mpdsub
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_streamProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/music/Artist/song.flac", "/radio.mp3":
+			http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader("hello world"))
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name  string
+		id    string
+		rng   string
+		files []string
+
+		xmlError *subsonicError
+		httpCode int
+		body     string
+	}{
+		{
+			name:     "mount",
+			id:       "2",
+			httpCode: http.StatusOK,
+			body:     "hello world",
+		},
+		{
+			name:     "mount, range",
+			id:       "2",
+			rng:      "bytes=6-",
+			httpCode: http.StatusPartialContent,
+			body:     "world",
+		},
+		{
+			name:     "mount, not found",
+			id:       "3",
+			xmlError: &subsonicError{Code: codeNotFound},
+		},
+		{
+			name:     "remote URI",
+			id:       "4",
+			httpCode: http.StatusOK,
+			body:     "hello world",
+		},
+		{
+			name:     "remote URI, upstream error",
+			id:       "5",
+			xmlError: &subsonicError{Code: codeGeneric},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &memoryDatabase{
+				files: []string{
+					"nas/Artist/song.flac",
+					"nas/missing.flac",
+					upstream.URL + "/radio.mp3",
+					upstream.URL + "/error",
+				},
+			}
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = "/var/music"
+			cfg.Mounts = map[string]string{
+				"nas": upstream.URL + "/music",
+			}
+
+			values.Set("id", tt.id)
+
+			withServer(t, db, nil, cfg, func(base string) {
+				req, err := http.NewRequest(http.MethodGet, base+"/rest/stream.view?"+values.Encode(), nil)
+				if err != nil {
+					t.Fatalf("failed to create HTTP request: %v", err)
+				}
+				if tt.rng != "" {
+					req.Header.Set("Range", tt.rng)
+				}
+
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("failed to perform HTTP request: %v", err)
+				}
+
+				if tt.xmlError != nil {
+					c := mustDecodeXML(t, res)
+					if want, got := tt.xmlError.Code, c.Error.Code; want != got {
+						t.Fatalf("unexpected XML error code::\n- want: %v\n-  got: %v",
+							want, got)
+					}
+
+					return
+				}
+
+				if want, got := tt.httpCode, res.StatusCode; want != got {
+					t.Fatalf("unexpected HTTP status code:\n- want: %03d\n-  got: %03d",
+						want, got)
+				}
+
+				if tt.body == "" {
+					return
+				}
+
+				b, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatalf("failed to read body: %v", err)
+				}
+				_ = res.Body.Close()
+
+				if want, got := tt.body, string(b); want != got {
+					t.Fatalf("unexpected body:\n- want: %q\n-  got: %q",
+						want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServer_downloadProxy(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/music/Artist/song.flac" {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, strings.NewReader("hello world"))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name        string
+		id          string
+		disposition string
+		body        string
+		zip         bool
+	}{
+		{
+			name:        "file",
+			id:          "2",
+			disposition: `attachment; filename=song.flac`,
+			body:        "hello world",
+		},
+		{
+			name:        "directory",
+			id:          "1",
+			disposition: `attachment; filename=Artist.zip`,
+			zip:         true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &memoryDatabase{
+				files: []string{"nas/Artist/song.flac"},
+			}
+
+			cfg, values := configAuth()
+			cfg.MusicDirectory = "/var/music"
+			cfg.Mounts = map[string]string{
+				"nas": upstream.URL + "/music",
+			}
+
+			values.Set("id", tt.id)
+
+			withServer(t, db, nil, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, "/rest/download.view", values)
+
+				if want, got := tt.disposition, res.Header.Get("Content-Disposition"); want != got {
+					t.Fatalf("unexpected Content-Disposition header:\n- want: %q\n-  got: %q",
+						want, got)
+				}
+
+				b, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatalf("failed to read body: %v", err)
+				}
+				_ = res.Body.Close()
+
+				if !tt.zip {
+					if want, got := tt.body, string(b); want != got {
+						t.Fatalf("unexpected body:\n- want: %q\n-  got: %q",
+							want, got)
+					}
+
+					return
+				}
+
+				// Remote files are omitted, but the archive must be complete
+				zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+				if err != nil {
+					t.Fatalf("failed to open zip: %v", err)
+				}
+				if len(zr.File) != 0 {
+					t.Fatalf("unexpected files in zip: %v", zr.File)
+				}
+			})
+		})
+	}
+}
+
+func Test_folderRemoteURL(t *testing.T) {
+	f := &folder{
+		Mounts: map[string]string{
+			"nas":  "http://nas/music",
+			"root": "http://nas",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		u      string
+		remote bool
+	}{
+		{
+			name: "Artist/song.flac",
+		},
+		{
+			name:   "http://example.com/radio.mp3?token=foo",
+			u:      "http://example.com/radio.mp3?token=foo",
+			remote: true,
+		},
+		{
+			name:   "nas/Artist/song.flac",
+			u:      "http://nas/music/Artist/song.flac",
+			remote: true,
+		},
+		{
+			name:   "nas/Artist/../song.flac",
+			u:      "http://nas/music/song.flac",
+			remote: true,
+		},
+		{
+			name:   "nas/../secret.flac",
+			remote: true,
+		},
+		{
+			name:   "nas/Artist/../../../secret.flac",
+			remote: true,
+		},
+		{
+			name:   "root/../song.flac",
+			u:      "http://nas/song.flac",
+			remote: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, remote := f.remoteURL(tt.name)
+			if tt.remote != remote || tt.u != u {
+				t.Fatalf("unexpected remote URL:\n- want: %q, %v\n-  got: %q, %v",
+					tt.u, tt.remote, u, remote)
+			}
+		})
+	}
+}
+
+func Test_remoteName(t *testing.T) {
+	tests := []struct {
+		u    string
+		name string
+	}{
+		{
+			u:    "http://nas/music/song.flac",
+			name: "song.flac",
+		},
+		{
+			u:    "http://nas/music/My%20Song.mp3?token=secret",
+			name: "My Song.mp3",
+		},
+		{
+			u:    "http://example.com",
+			name: "download",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.u, func(t *testing.T) {
+			if want, got := tt.name, remoteName(tt.u); want != got {
+				t.Fatalf("unexpected name:\n- want: %q\n-  got: %q", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package mpdsub
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+)
+
+// A radioStation is an internet radio station stored by the Server.
+type radioStation struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	StreamURL   string `json:"streamUrl"`
+	HomepageURL string `json:"homepageUrl,omitempty"`
+}
+
+// getInternetRadioStations returns all internet radio stations stored by the
+// Server, followed by any HTTP streams found in MPD stored playlists.  The IDs
+// of playlist stations are derived from their URIs, so a stream which appears
+// in several playlists or folders is only returned once.
+func (s *Server) getInternetRadioStations(w http.ResponseWriter, r *http.Request) {
+	var stations []internetRadioStation
+	s.state.view(func(st *state) {
+		for _, rs := range st.RadioStations {
+			stations = append(stations, internetRadioStation{
+				ID:          strconv.Itoa(rs.ID),
+				Name:        rs.Name,
+				StreamURL:   rs.StreamURL,
+				HomePageURL: rs.HomepageURL,
+			})
+		}
+	})
+
+	seen := make(map[string]bool)
+	for _, f := range s.folders {
+		ps, err := playlistStations(f.db)
+		if err != nil {
+			s.logf("error listing playlists from mpd for getting radio stations: %v", err)
+			writeXML(w, errGeneric)
+			return
+		}
+
+		for _, p := range ps {
+			if seen[p.ID] {
+				continue
+			}
+			seen[p.ID] = true
+
+			stations = append(stations, p)
+		}
+	}
+
+	writeXML(w, func(c *container) {
+		c.InternetRadioStations = &internetRadioStationsContainer{
+			Stations: stations,
+		}
+	})
+}
+
+// playlistStations returns an internet radio station for each remote URI
+// in an MPD database's stored playlists.  These stations are read-only, and
+// their IDs are derived from their URIs so that they remain stable.
+func playlistStations(db database) ([]internetRadioStation, error) {
+	playlists, err := db.ListPlaylists()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []internetRadioStation
+	for _, p := range playlists {
+		name := p["playlist"]
+
+		entries, err := db.PlaylistContents(name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, e := range entries {
+			uri := e["file"]
+			if !isRemoteURI(uri) {
+				continue
+			}
+
+			// Prefer the stream's own name, if MPD knows it
+			sName := name
+			switch {
+			case e["Name"] != "":
+				sName = e["Name"]
+			case e["Title"] != "":
+				sName = e["Title"]
+			}
+
+			h := sha1.Sum([]byte(uri))
+			out = append(out, internetRadioStation{
+				ID:        "mpd-" + hex.EncodeToString(h[:8]),
+				Name:      sName,
+				StreamURL: uri,
+			})
+		}
+	}
+
+	return out, nil
+}
+
+// createInternetRadioStation stores a new internet radio station.
+func (s *Server) createInternetRadioStation(w http.ResponseWriter, r *http.Request) {
+	rs, ok := parseRadioStation(w, r)
+	if !ok {
+		return
+	}
+
+	err := s.state.update(func(st *state) {
+		st.NextRadioStationID++
+		rs.ID = st.NextRadioStationID
+
+		st.RadioStations = append(st.RadioStations, rs)
+	})
+	if err != nil {
+		s.logf("error creating radio station: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	writeXML(w, nil)
+}
+
+// updateInternetRadioStation updates a stored internet radio station.
+// Stations found in MPD stored playlists cannot be updated.
+func (s *Server) updateInternetRadioStation(w http.ResponseWriter, r *http.Request) {
+	id, ok := radioStationID(w, r)
+	if !ok {
+		return
+	}
+
+	rs, ok := parseRadioStation(w, r)
+	if !ok {
+		return
+	}
+	rs.ID = id
+
+	var found bool
+	err := s.state.update(func(st *state) {
+		for i := range st.RadioStations {
+			if st.RadioStations[i].ID == id {
+				st.RadioStations[i] = rs
+				found = true
+				return
+			}
+		}
+	})
+	if err != nil {
+		s.logf("error updating radio station: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+	if !found {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	writeXML(w, nil)
+}
+
+// deleteInternetRadioStation deletes a stored internet radio station.
+// Stations found in MPD stored playlists cannot be deleted.
+func (s *Server) deleteInternetRadioStation(w http.ResponseWriter, r *http.Request) {
+	id, ok := radioStationID(w, r)
+	if !ok {
+		return
+	}
+
+	var found bool
+	err := s.state.update(func(st *state) {
+		for i := range st.RadioStations {
+			if st.RadioStations[i].ID == id {
+				st.RadioStations = append(st.RadioStations[:i], st.RadioStations[i+1:]...)
+				found = true
+				return
+			}
+		}
+	})
+	if err != nil {
+		s.logf("error deleting radio station: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+	if !found {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	writeXML(w, nil)
+}
+
+// parseRadioStation parses the parameters of an internet radio station from
+// a request.  If a parameter is missing or invalid, an error is written to w
+// and parseRadioStation returns false.
+func parseRadioStation(w http.ResponseWriter, r *http.Request) (radioStation, bool) {
+	rs := radioStation{
+		Name:        r.Form.Get("name"),
+		StreamURL:   r.Form.Get("streamUrl"),
+		HomepageURL: r.Form.Get("homepageUrl"),
+	}
+
+	if rs.Name == "" || rs.StreamURL == "" {
+		writeXML(w, errMissingParameter)
+		return radioStation{}, false
+	}
+
+	if !isRemoteURI(rs.StreamURL) {
+		writeXML(w, errGeneric)
+		return radioStation{}, false
+	}
+
+	return rs, true
+}
+
+// radioStationID parses the ID of a stored internet radio station from a
+// request.  If the ID is missing or does not refer to a stored station, an
+// error is written to w and radioStationID returns false.
+func radioStationID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return 0, false
+	}
+
+	id, err := strconv.Atoi(qID)
+	if err != nil {
+		writeXML(w, errNotFound)
+		return 0, false
+	}
+
+	return id, true
+}
@@ -0,0 +1,115 @@
+package mpdsub
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+func TestServerInternetRadioStations(t *testing.T) {
+	db := &memoryDatabase{
+		playlists: map[string][]mpd.Attrs{
+			"radio": {
+				{"file": "http://example.com/stream", "Name": "Example FM"},
+				{"file": "Artist/song.flac"},
+			},
+			// The same stream in another playlist is only listed once
+			"wishlist": {
+				{"file": "http://example.com/stream", "Name": "Duplicate"},
+			},
+		},
+	}
+
+	cfg := &Config{
+		Users: []User{
+			{Name: "admin", Password: "admin", Roles: RoleAdmin},
+			{Name: "user", Password: "user", Roles: RoleStream},
+		},
+	}
+
+	withServer(t, db, nil, cfg, func(base string) {
+		stations := func() []internetRadioStation {
+			c := testUserRequest(t, base, "user", "/rest/getInternetRadioStations.view")
+			return c.InternetRadioStations.Stations
+		}
+
+		playlist := internetRadioStation{
+			ID:        "mpd-0bee5d485b67f400",
+			Name:      "Example FM",
+			StreamURL: "http://example.com/stream",
+		}
+
+		if want, got := []internetRadioStation{playlist}, stations(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected stations:\n- want: %+v\n-  got: %+v", want, got)
+		}
+
+		errTests := []struct {
+			name   string
+			user   string
+			target string
+			kv     []string
+			code   int
+		}{
+			{
+				name:   "create, not admin",
+				user:   "user",
+				target: "/rest/createInternetRadioStation.view",
+				kv:     []string{"name", "Foo", "streamUrl", "http://foo/"},
+				code:   codeNotAuthorized,
+			},
+			{
+				name:   "create, no stream URL",
+				user:   "admin",
+				target: "/rest/createInternetRadioStation.view",
+				kv:     []string{"name", "Foo"},
+				code:   codeMissingParameter,
+			},
+			{
+				name:   "create, not a URL",
+				user:   "admin",
+				target: "/rest/createInternetRadioStation.view",
+				kv:     []string{"name", "Foo", "streamUrl", "/etc/passwd"},
+				code:   codeGeneric,
+			},
+			{
+				name:   "update, playlist station",
+				user:   "admin",
+				target: "/rest/updateInternetRadioStation.view",
+				kv:     []string{"id", playlist.ID, "name", "Foo", "streamUrl", "http://foo/"},
+				code:   codeNotFound,
+			},
+			{
+				name:   "delete, not found",
+				user:   "admin",
+				target: "/rest/deleteInternetRadioStation.view",
+				kv:     []string{"id", "9"},
+				code:   codeNotFound,
+			},
+		}
+
+		for _, tt := range errTests {
+			c := testUserRequest(t, base, tt.user, tt.target, tt.kv...)
+			if want, got := tt.code, c.Error.Code; want != got {
+				t.Fatalf("%s: unexpected error code:\n- want: %v\n-  got: %v", tt.name, want, got)
+			}
+		}
+
+		testUserRequest(t, base, "admin", "/rest/createInternetRadioStation.view",
+			"name", "Foo", "streamUrl", "http://foo/", "homepageUrl", "http://foo.com/")
+		testUserRequest(t, base, "admin", "/rest/createInternetRadioStation.view",
+			"name", "Bar", "streamUrl", "https://bar/")
+		testUserRequest(t, base, "admin", "/rest/updateInternetRadioStation.view",
+			"id", "2", "name", "Baz", "streamUrl", "https://baz/")
+		testUserRequest(t, base, "admin", "/rest/deleteInternetRadioStation.view", "id", "1")
+
+		want := []internetRadioStation{
+			{ID: "2", Name: "Baz", StreamURL: "https://baz/"},
+			playlist,
+		}
+
+		if got := stations(); !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected stations:\n- want: %+v\n-  got: %+v", want, got)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package mpdsub
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A SymlinkPolicy specifies how symbolic links are handled when resolving
+// the paths of files in a music directory.
+type SymlinkPolicy int
+
+// Possible SymlinkPolicy values.
+const (
+	// SymlinksWithinRoot permits symbolic links only if their targets
+	// are also within the music directory.  This is the default.
+	SymlinksWithinRoot SymlinkPolicy = iota
+
+	// SymlinksFollow permits symbolic links to any target.
+	SymlinksFollow
+
+	// SymlinksDeny rejects any path which traverses a symbolic link.
+	SymlinksDeny
+)
+
+var (
+	// errPathEscapes is returned when a path refers to a file outside of
+	// the music directory.
+	errPathEscapes = errors.New("path escapes music directory")
+
+	// errPathSymlink is returned when a path traverses a symbolic link,
+	// and symbolic links are not permitted.
+	errPathSymlink = errors.New("path traverses a symbolic link")
+)
+
+// resolvePath resolves the path of the file with the input name, relative to
+// the music directory root, applying the input symbolic link policy.  Names
+// which would refer to files outside of root are rejected, regardless of
+// policy.
+func resolvePath(fs filesystem, root string, name string, policy SymlinkPolicy) (string, error) {
+	// MPD URIs are always relative to the music directory, so anything else
+	// is suspect
+	if filepath.IsAbs(name) {
+		return "", errPathEscapes
+	}
+
+	p := filepath.Join(root, name)
+	if !within(root, p) {
+		return "", errPathEscapes
+	}
+
+	if policy == SymlinksFollow {
+		return p, nil
+	}
+
+	// The music directory itself may be a symbolic link, so its target is
+	// the root used for comparisons
+	rroot, err := fs.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+
+	rp, err := fs.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+
+	switch policy {
+	case SymlinksDeny:
+		if rp != filepath.Join(rroot, name) {
+			return "", errPathSymlink
+		}
+	default:
+		if !within(rroot, rp) {
+			return "", errPathEscapes
+		}
+	}
+
+	return rp, nil
+}
+
+// within determines if path p is root or is beneath root.
+func within(root string, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
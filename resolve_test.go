@@ -0,0 +1,91 @@
+package mpdsub
+
+import (
+	"testing"
+)
+
+func Test_resolvePath(t *testing.T) {
+	const root = "/var/music"
+
+	fs := &memoryFilesystem{
+		links: map[string]string{
+			// Music directory is itself a link
+			"/var/music": "/srv/music",
+			// Links within and outside of the music directory
+			"/srv/music/inside":  "/srv/music/Artist",
+			"/srv/music/outside": "/etc",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		file   string
+		policy SymlinkPolicy
+
+		path string
+		err  error
+	}{
+		{
+			name: "absolute",
+			file: "/etc/passwd",
+			err:  errPathEscapes,
+		},
+		{
+			name:   "parent directory",
+			file:   "../../etc/passwd",
+			policy: SymlinksFollow,
+			err:    errPathEscapes,
+		},
+		{
+			name: "cleaned parent directory",
+			file: "Artist/../../music2/song.flac",
+			err:  errPathEscapes,
+		},
+		{
+			name: "no links",
+			file: "Artist/song.flac",
+			path: "/srv/music/Artist/song.flac",
+		},
+		{
+			name: "link within root",
+			file: "inside/song.flac",
+			path: "/srv/music/Artist/song.flac",
+		},
+		{
+			name: "link outside root",
+			file: "outside/passwd",
+			err:  errPathEscapes,
+		},
+		{
+			name:   "link outside root, follow",
+			file:   "outside/passwd",
+			policy: SymlinksFollow,
+			path:   "/var/music/outside/passwd",
+		},
+		{
+			name:   "no links, deny",
+			file:   "Artist/song.flac",
+			policy: SymlinksDeny,
+			path:   "/srv/music/Artist/song.flac",
+		},
+		{
+			name:   "link within root, deny",
+			file:   "inside/song.flac",
+			policy: SymlinksDeny,
+			err:    errPathSymlink,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := resolvePath(fs, root, tt.file, tt.policy)
+			if want, got := tt.err, err; want != got {
+				t.Fatalf("unexpected error:\n- want: %v\n-  got: %v", want, got)
+			}
+
+			if want, got := tt.path, path; want != got {
+				t.Fatalf("unexpected path:\n- want: %q\n-  got: %q", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package mpdsub
+
+import (
+	"net/http"
+)
+
+// scrobble records that one or more files, specified using repeated id
+// parameters, have been played.  Notifications which are not submissions,
+// indicating that a file is now playing, are accepted but not recorded.
+//
+// Each submission rewrites the state file, which holds all persisted state
+// and not only play counts.  Clients scrobble at most once per played file,
+// so this is rarely a burden, but multiple plays should be submitted in a
+// single request where possible.
+func (s *Server) scrobble(w http.ResponseWriter, r *http.Request) {
+	ids := r.Form["id"]
+	if len(ids) == 0 {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	refs := make([]fileRef, 0, len(ids))
+	for _, qID := range ids {
+		folder, _, file, ok := s.lookupItem(w, r, qID)
+		if !ok {
+			return
+		}
+		if file.Dir {
+			writeXML(w, errNotFound)
+			return
+		}
+
+		refs = append(refs, fileRef{Folder: folder.ID, Name: file.Name})
+	}
+
+	if r.Form.Get("submission") == "false" {
+		writeXML(w, nil)
+		return
+	}
+
+	err := s.state.update(func(st *state) {
+		if st.PlayCounts == nil {
+			st.PlayCounts = make(map[int]map[string]int)
+		}
+
+		for _, ref := range refs {
+			if st.PlayCounts[ref.Folder] == nil {
+				st.PlayCounts[ref.Folder] = make(map[string]int)
+			}
+
+			st.PlayCounts[ref.Folder][ref.Name]++
+		}
+	})
+	if err != nil {
+		s.logf("error recording plays: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	writeXML(w, nil)
+}
+
+// playCount returns the number of times the file referred to by ref has been
+// played.
+func (st *state) playCount(ref fileRef) int {
+	return st.PlayCounts[ref.Folder][ref.Name]
+}
@@ -0,0 +1,127 @@
+package mpdsub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+func TestServer_scrobble(t *testing.T) {
+	db := &memoryDatabase{
+		files: []string{
+			"Kids/song.mp3",
+			"Rock/song.mp3",
+		},
+		attrs: map[string]mpd.Attrs{
+			"Kids/song.mp3": {},
+			"Rock/song.mp3": {},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		user  string
+		kv    []string
+		code  int
+		plays map[int]map[string]int
+	}{
+		{
+			name: "missing id",
+			code: codeMissingParameter,
+		},
+		{
+			name:  "submission",
+			kv:    []string{"id", "1"},
+			plays: map[int]map[string]int{0: {"Kids/song.mp3": 1}},
+		},
+		{
+			name: "now playing",
+			kv:   []string{"id", "1", "submission", "false"},
+		},
+		{
+			name: "multiple",
+			kv:   []string{"id", "1", "id", "1", "id", "3"},
+			plays: map[int]map[string]int{0: {
+				"Kids/song.mp3": 2,
+				"Rock/song.mp3": 1,
+			}},
+		},
+		{
+			name: "unknown",
+			kv:   []string{"id", "1", "id", "100"},
+			code: codeNotFound,
+		},
+		{
+			name: "directory",
+			kv:   []string{"id", "0"},
+			code: codeNotFound,
+		},
+		{
+			name: "forbidden",
+			user: "kids",
+			kv:   []string{"id", "1", "id", "3"},
+			code: codeNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "mpdsub-scrobble")
+			if err != nil {
+				t.Fatalf("failed to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+
+			cfg := &Config{
+				StateDirectory: dir,
+				Users: []User{
+					{Name: "test", Password: "test"},
+					{Name: "kids", Password: "kids", Directories: []string{"Kids"}},
+				},
+			}
+
+			user := tt.user
+			if user == "" {
+				user = "test"
+			}
+
+			withServer(t, db, nil, cfg, func(base string) {
+				c := testUserRequest(t, base, user, "/rest/scrobble.view", tt.kv...)
+
+				if tt.code != 0 {
+					if c.Error == nil {
+						t.Fatal("expected an error, but none occurred")
+					}
+					if want, got := tt.code, c.Error.Code; want != got {
+						t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+					}
+				} else if c.Error != nil {
+					t.Fatalf("unexpected error: %+v", c.Error)
+				}
+			})
+
+			// Rejected requests and now playing notifications must not
+			// record any plays
+			var st state
+			b, err := ioutil.ReadFile(filepath.Join(dir, stateFile))
+			switch {
+			case os.IsNotExist(err):
+			case err != nil:
+				t.Fatalf("failed to read state: %v", err)
+			default:
+				if err := json.Unmarshal(b, &st); err != nil {
+					t.Fatalf("failed to decode state: %v", err)
+				}
+			}
+
+			if want, got := tt.plays, st.PlayCounts; !reflect.DeepEqual(want, got) {
+				t.Fatalf("unexpected play counts:\n- want: %v\n-  got: %v", want, got)
+			}
+		})
+	}
+}
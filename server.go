@@ -3,11 +3,17 @@ package mpdsub
 import (
 	"context"
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/hex"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -19,13 +25,28 @@ import (
 // of an MPD server.  It enables Subsonic clients to read information from
 // MPD's database and stream files from the local filesystem.
 type Server struct {
-	db  database
-	fs  filesystem
-	cfg *Config
-	ll  *log.Logger
+	folders []*folder
+	fs      filesystem
+	client  *http.Client
+	cfg     *Config
+	ll      *log.Logger
+
+	users   map[string]*User
+	apiKeys map[string]*User
+
+	state *stateStore
+
+	// artKey signs the cover art URLs returned in artist and album info.
+	artKey []byte
+
+	// playerMu serializes updates to the queue of Config.Player.
+	playerMu sync.Mutex
 
 	mux *http.ServeMux
 
+	// ctx is canceled when the Server is closed, to stop background work
+	// such as podcast downloads.
+	ctx    context.Context
 	cancel context.CancelFunc
 	wg     *sync.WaitGroup
 }
@@ -33,10 +54,26 @@ type Server struct {
 // Config specifies configuration for a Server.
 type Config struct {
 	// Credentials which Subsonic clients must provide to authenticate
-	// to the Server.
+	// to the Server.  If SubsonicUser is set, it is treated as an
+	// additional user with the RoleAdmin role.
 	SubsonicUser     string
 	SubsonicPassword string
 
+	// Users specifies an optional set of users which may authenticate
+	// to the Server, each with their own set of roles.
+	Users []User
+
+	// ProxyAuthHeader specifies an optional HTTP header, such as
+	// X-Forwarded-User, which carries the name of a user who has already
+	// been authenticated by a reverse proxy.  The header is only honored
+	// for requests which originate from TrustedProxies, and such requests
+	// do not need to provide any other Subsonic credentials.
+	ProxyAuthHeader string
+
+	// TrustedProxies specifies the networks of reverse proxies which are
+	// trusted to set ProxyAuthHeader.
+	TrustedProxies []*net.IPNet
+
 	// MusicDirectory specifies the root music directory for the MPD server.
 	// This must match the value specified in MPD's configuration to enable
 	// streaming media through the Server.
@@ -46,6 +83,59 @@ type Config struct {
 	//  - MPD configuration file
 	MusicDirectory string
 
+	// Symlinks specifies how symbolic links are handled when opening files
+	// in a music directory.  By default, only symbolic links whose targets
+	// are within the music directory are permitted.
+	Symlinks SymlinkPolicy
+
+	// Mounts specifies optional MPD storage mounts whose files are not
+	// present in MusicDirectory.  Each key is a mount point, and each value
+	// is the base HTTP URL from which files beneath the mount point are
+	// proxied when streaming.  Files whose MPD URI is itself an HTTP URL are
+	// always proxied.
+	Mounts map[string]string
+
+	// HTTPClient specifies an optional HTTP client used for outgoing
+	// requests.  If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Folders specifies optional additional MPD servers to expose as
+	// separate music folders, alongside the MPD server passed to NewServer.
+	Folders []Folder
+
+	// Transcoder specifies an optional Transcoder used to honor the format
+	// and maxBitRate parameters when streaming.  If Transcoder is nil,
+	// files are always streamed in their original format.
+	Transcoder Transcoder
+
+	// TranscodeFormat specifies the format used when a client requests a
+	// maximum bitrate without requesting a format.  If empty, such requests
+	// are served in the original format.
+	TranscodeFormat string
+
+	// TranscodeBitRate specifies the bitrate in kbps used when a client
+	// requests a transcoded stream without requesting a maximum bitrate.
+	// If 0, the Transcoder chooses its own default.
+	TranscodeBitRate int
+
+	// StateDirectory specifies an optional directory in which the Server
+	// persists state created by users, such as bookmarks.  If empty, state
+	// is only kept in memory and is lost when the Server stops.
+	StateDirectory string
+
+	// PodcastDirectory specifies an optional directory, relative to
+	// MusicDirectory, into which podcast episodes are downloaded so that
+	// MPD may index them.  If empty, podcasts cannot be managed.
+	PodcastDirectory string
+
+	// Player specifies an optional MPD client into whose queue play queues
+	// saved by users with RoleJukebox are mirrored, so that they may be
+	// continued on MPD's outputs.  A play queue is only mirrored when its
+	// entries change.  Only files from the MPD server passed to NewServer
+	// are mirrored.  To mirror into an MPD partition, use a dedicated
+	// client which has been switched to that partition.
+	Player Player
+
 	// Verbose specifies if the server should enable verbose logging.
 	Verbose bool
 
@@ -68,31 +158,135 @@ func NewServer(c *mpd.Client, cfg *Config) *Server {
 		cfg.Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
 	}
 
-	return newServer(c, &osFilesystem{}, cfg)
+	folders := []*folder{newFolder(0, "", c, cfg.MusicDirectory)}
+	folders[0].Mounts = cfg.Mounts
+
+	for i, f := range cfg.Folders {
+		ff := newFolder(i+1, f.Name, f.Client, f.MusicDirectory)
+		ff.Mounts = f.Mounts
+
+		folders = append(folders, ff)
+	}
+
+	return newServer(folders, &osFilesystem{}, cfg)
 }
 
 // newServer is the internal constructor for Server.  It enables swapping in
 // arbitrary database implementations for testing.  It also sets up all Subsonic
 // API routes.
-func newServer(db database, fs filesystem, cfg *Config) *Server {
+func newServer(folders []*folder, fs filesystem, cfg *Config) *Server {
 	s := &Server{
-		db:  db,
-		fs:  fs,
-		cfg: cfg,
+		folders: folders,
+		fs:      fs,
+		client:  cfg.HTTPClient,
+		cfg:     cfg,
+		users:   make(map[string]*User, len(cfg.Users)+1),
+		apiKeys: make(map[string]*User),
+	}
+
+	if s.client == nil {
+		s.client = http.DefaultClient
+	}
+
+	var statePath string
+	if cfg.StateDirectory != "" {
+		statePath = filepath.Join(cfg.StateDirectory, stateFile)
+	}
+
+	st, err := newStateStore(statePath)
+	if err != nil {
+		// Keep state in memory rather than overwriting state which could
+		// not be loaded
+		s.logf("failed to load state from %q, state will not be persisted: %v", statePath, err)
+		st, _ = newStateStore("")
+	}
+	s.state = st
+
+	// Signed cover art URLs are only valid for the lifetime of the Server
+	s.artKey = make([]byte, 32)
+	if _, err := rand.Read(s.artKey); err != nil {
+		s.logf("failed to generate cover art URL key, image URLs are disabled: %v", err)
+		s.artKey = nil
+	}
+
+	for i := range cfg.Users {
+		u := &cfg.Users[i]
+		s.users[u.Name] = u
+
+		for _, k := range u.APIKeys {
+			s.apiKeys[k] = u
+		}
+	}
+	if cfg.SubsonicUser != "" {
+		s.users[cfg.SubsonicUser] = &User{
+			Name:     cfg.SubsonicUser,
+			Password: cfg.SubsonicPassword,
+			Roles:    RoleAdmin,
+		}
 	}
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/rest/getLicense.view", s.getLicense)
-	mux.HandleFunc("/rest/getIndexes.view", s.getIndexes)
-	mux.HandleFunc("/rest/getMusicDirectory.view", s.getMusicDirectory)
-	mux.HandleFunc("/rest/getMusicFolders.view", s.getMusicFolders)
-	mux.HandleFunc("/rest/ping.view", s.ping)
-	mux.HandleFunc("/rest/stream.view", s.stream)
+	// API methods are reachable both with and without the .view suffix
+	handle := func(method string, fn http.HandlerFunc) {
+		mux.HandleFunc("/rest/"+method, fn)
+		mux.HandleFunc("/rest/"+method+".view", fn)
+	}
+
+	handle("createBookmark", s.createBookmark)
+	handle("createInternetRadioStation", s.requireRole(RoleAdmin, s.createInternetRadioStation))
+	handle("createPodcastChannel", s.requireRole(RolePodcast, s.requirePodcasts(s.createPodcastChannel)))
+	handle("createShare", s.requireRole(RoleShare, s.createShare))
+	handle("deleteBookmark", s.deleteBookmark)
+	handle("deleteInternetRadioStation", s.requireRole(RoleAdmin, s.deleteInternetRadioStation))
+	handle("deletePodcastEpisode", s.requireRole(RolePodcast, s.requirePodcasts(s.deletePodcastEpisode)))
+	handle("deleteShare", s.requireRole(RoleShare, s.deleteShare))
+	handle("download", s.requireRole(RoleDownload, s.download))
+	handle("downloadPodcastEpisode", s.requireRole(RolePodcast, s.requirePodcasts(s.downloadPodcastEpisode)))
+	handle("getAlbumInfo", s.getAlbumInfo)
+	handle("getAlbumInfo2", s.getAlbumInfo)
+	handle("getArtistInfo", s.getArtistInfo)
+	handle("getArtistInfo2", s.getArtistInfo2)
+	handle("getBookmarks", s.getBookmarks)
+	handle("getCoverArt", s.requireRole(RoleCoverArt, s.getCoverArt))
+	handle("getLicense", s.getLicense)
+	handle("getLyrics", s.getLyrics)
+	handle("getLyricsBySongId", s.getLyricsBySongId)
+	handle("getIndexes", s.getIndexes)
+	handle("getInternetRadioStations", s.getInternetRadioStations)
+	handle("getMusicDirectory", s.getMusicDirectory)
+	handle("getMusicFolders", s.getMusicFolders)
+	handle("getNewestPodcasts", s.getNewestPodcasts)
+	handle("getOpenSubsonicExtensions", s.getOpenSubsonicExtensions)
+	handle("getPlayQueue", s.getPlayQueue)
+	handle("getPodcasts", s.getPodcasts)
+	handle("getShares", s.getShares)
+	handle("getSimilarSongs", s.getSimilarSongs)
+	handle("getSimilarSongs2", s.getSimilarSongs2)
+	handle("getTopSongs", s.getTopSongs)
+	handle("ping", s.ping)
+	handle("refreshPodcasts", s.requireRole(RolePodcast, s.requirePodcasts(s.refreshPodcasts)))
+	handle("savePlayQueue", s.savePlayQueue)
+	handle("scrobble", s.scrobble)
+	handle("stream", s.requireRole(RoleStream, s.stream))
+	handle("updateInternetRadioStation", s.requireRole(RoleAdmin, s.updateInternetRadioStation))
+	handle("updateShare", s.requireRole(RoleShare, s.updateShare))
+
+	// HLS methods carry their own suffixes
+	mux.HandleFunc("/rest/hls.m3u8", s.requireRole(RoleStream, s.hls))
+	mux.HandleFunc("/rest/hls.ts", s.requireRole(RoleStream, s.hlsSegment))
+
+	// Shares are served as HTML pages to anyone with a share's link
+	mux.HandleFunc(sharePrefix, s.serveShare)
+	mux.HandleFunc(coverArtPrefix, s.serveSignedCoverArt)
+
+	// Unknown routes receive a Subsonic error rather than an HTML page
+	mux.HandleFunc("/", s.notFound)
 
 	s.mux = mux
 
 	ctx, cancel := context.WithCancel(context.Background())
+	s.ctx = ctx
 	s.cancel = cancel
 	s.wg = new(sync.WaitGroup)
 
@@ -111,8 +305,15 @@ func (s *Server) keepalive(ctx context.Context) {
 
 	tick := time.NewTicker(s.cfg.Keepalive)
 	for {
-		if err := s.db.Ping(); err != nil {
-			s.logf("failed to send keepalive message: %v", err)
+		for _, f := range s.folders {
+			if err := f.db.Ping(); err != nil {
+				s.logf("failed to send keepalive message to folder %q: %v", f.Name, err)
+			}
+		}
+		if s.cfg.Player != nil {
+			if err := s.cfg.Player.Ping(); err != nil {
+				s.logf("failed to send keepalive message to player: %v", err)
+			}
 		}
 
 		select {
@@ -143,25 +344,119 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Connection", "close")
 
-	rctx, ok := parseRequestContext(r)
-	if !ok {
-		// Subsonic API returns HTTP 200 on missing parameters
-		writeXML(w, errMissingParameter)
+	// Parameters may be provided in the URL query string or in a form body,
+	// for clients which POST their parameters
+	if err := r.ParseForm(); err != nil {
+		writeXML(w, errGeneric)
+		return
+	}
+
+	// Shared items may be retrieved without Subsonic credentials.  The share
+	// handlers only serve items which belong to an unexpired share
+	if strings.HasPrefix(r.URL.Path, sharePrefix) {
+		s.mux.ServeHTTP(w, trimSlash(r))
 		return
 	}
 
-	if !s.authenticate(rctx) {
-		// Subsonic API returns HTTP 200 on invalid authentication
-		writeXML(w, errUnauthorized)
+	// Cover art URLs from artist and album info carry their own signature
+	// instead of Subsonic credentials
+	if strings.HasPrefix(r.URL.Path, coverArtPrefix) {
+		s.mux.ServeHTTP(w, r)
 		return
 	}
 
-	s.mux.ServeHTTP(w, r)
+	// All Subsonic responses from here on use the requested format
+	w = &formatWriter{
+		ResponseWriter: w,
+		format:         r.Form.Get("f"),
+		callback:       r.Form.Get("callback"),
+	}
+
+	// Some methods may be called before a client authenticates, and
+	// before it knows which versions of the API the Server supports
+	if isPublic(r.URL.Path) {
+		s.mux.ServeHTTP(w, trimSlash(r))
+		return
+	}
+
+	// Reject clients which speak an incompatible version of the API, if
+	// they indicate their version
+	if v := r.Form.Get("v"); v != "" {
+		if errFn := checkVersion(v); errFn != nil {
+			writeXML(w, errFn)
+			return
+		}
+	}
+
+	var u *User
+	if name, trusted := s.proxyUser(r); trusted {
+		// User was already authenticated by a trusted reverse proxy
+		var ok bool
+		if u, ok = s.users[name]; !ok {
+			writeXML(w, errUnauthorized)
+			return
+		}
+	} else {
+		rctx, errFn := parseRequestContext(r)
+		if errFn != nil {
+			// Subsonic API returns HTTP 200 on missing or invalid parameters
+			writeXML(w, errFn)
+			return
+		}
+
+		if u, errFn = s.authenticate(rctx); errFn != nil {
+			// Subsonic API returns HTTP 200 on invalid authentication
+			writeXML(w, errFn)
+			return
+		}
+	}
+
+	s.mux.ServeHTTP(w, trimSlash(withUser(r, u)))
+}
+
+// publicMethods are the API methods which do not require authentication.
+var publicMethods = map[string]bool{
+	// OpenSubsonic clients probe for extensions before authenticating.
+	"getOpenSubsonicExtensions": true,
+}
+
+// isPublic reports whether the request path p refers to a method which does
+// not require authentication.
+func isPublic(p string) bool {
+	p = strings.TrimRight(p, "/")
+	if path.Dir(p) != "/rest" {
+		return false
+	}
+
+	return publicMethods[strings.TrimSuffix(path.Base(p), ".view")]
+}
+
+// trimSlash returns a copy of r with any trailing slashes removed from its
+// URL path, so that routes match regardless of trailing slashes.
+func trimSlash(r *http.Request) *http.Request {
+	p := strings.TrimRight(r.URL.Path, "/")
+	if p == r.URL.Path || p == "" {
+		return r
+	}
+
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	r2.URL.RawPath = ""
+
+	return r2
 }
 
 // logf is a convenience function to create a formatted log entry using the
-// Server's configured logger.
+// Server's configured logger, or the standard logger if none is configured.
 func (s *Server) logf(format string, v ...interface{}) {
+	if s.cfg.Logger == nil {
+		log.Printf(format, v...)
+		return
+	}
+
 	s.cfg.Logger.Printf(format, v...)
 }
 
@@ -176,28 +471,166 @@ const (
 	// authMethodTokenSalt is the recommended Subsonic authentication method,
 	// using a token and salt parameter with each request.
 	authMethodTokenSalt
+
+	// authMethodAPIKey is the OpenSubsonic API key authentication method,
+	// using only an API key parameter with each request.
+	authMethodAPIKey
 )
 
 // authenticate attempts to authenticate a user using the input requestContext.
-// It returns true if authentication is successful, or false if not.
-func (s *Server) authenticate(rctx *requestContext) bool {
-	if rctx.User != s.cfg.SubsonicUser {
-		return false
+// It returns the User if authentication is successful, or a function which
+// writes the appropriate Subsonic error if not.
+func (s *Server) authenticate(rctx *requestContext) (*User, func(c *container)) {
+	if rctx.authMethod == authMethodAPIKey {
+		u, ok := s.apiKeys[HashAPIKey(rctx.APIKey)]
+		if !ok {
+			return nil, errInvalidAPIKey
+		}
+
+		return u, nil
+	}
+
+	u, ok := s.users[rctx.User]
+	if !ok {
+		return nil, errUnauthorized
+	}
+
+	// Users without a password may only authenticate using an API key
+	if u.Password == "" {
+		if rctx.authMethod == authMethodTokenSalt {
+			return nil, errTokenAuthNotSupported
+		}
+
+		return nil, errUnauthorized
 	}
 
 	switch rctx.authMethod {
 	case authMethodPassword:
-		return rctx.Password == s.cfg.SubsonicPassword
+		ok = rctx.Password == u.Password
 	case authMethodTokenSalt:
 		// From Subsonic documentation:
 		// http://www.subsonic.org/pages/api.jsp
 		//   token = md5(password + salt)
 		h := md5.New()
-		_, _ = io.WriteString(h, s.cfg.SubsonicPassword+rctx.Salt)
-		return rctx.Token == hex.EncodeToString(h.Sum(nil))
+		_, _ = io.WriteString(h, u.Password+rctx.Salt)
+		ok = rctx.Token == hex.EncodeToString(h.Sum(nil))
 	default:
+		ok = false
+	}
+
+	if !ok {
+		return nil, errUnauthorized
+	}
+
+	return u, nil
+}
+
+// checkVersion checks if a client's API version is compatible with the
+// Server's API version.  If it is not, it returns a function which writes the
+// appropriate Subsonic error.  Versions which cannot be parsed are permitted,
+// as are newer minor versions, which OpenSubsonic clients commonly send and
+// which remain compatible with the methods the Server implements.
+func checkVersion(v string) func(c *container) {
+	cMajor, _, ok := parseVersion(v)
+	if !ok {
+		return nil
+	}
+
+	sMajor, _, _ := parseVersion(apiVersion)
+
+	switch {
+	case cMajor < sMajor:
+		return errClientVersion
+	case cMajor > sMajor:
+		return errServerVersion
+	}
+
+	return nil
+}
+
+// parseVersion parses the major and minor components of an API version
+// string such as "1.14.0".
+func parseVersion(v string) (major int, minor int, ok bool) {
+	ss := strings.Split(v, ".")
+	if len(ss) < 2 {
+		return 0, 0, false
+	}
+
+	major, err := strconv.Atoi(ss[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	minor, err = strconv.Atoi(ss[1])
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return major, minor, true
+}
+
+// proxyUser returns the name of the user set in ProxyAuthHeader by a trusted
+// reverse proxy.  It returns false if the request did not pass through a
+// trusted reverse proxy, or if the header is not set.
+func (s *Server) proxyUser(r *http.Request) (string, bool) {
+	if s.cfg.ProxyAuthHeader == "" {
+		return "", false
+	}
+
+	name := r.Header.Get(s.cfg.ProxyAuthHeader)
+	if name == "" {
+		return "", false
+	}
+
+	if !s.fromTrustedProxy(r) {
+		return "", false
+	}
+
+	return name, true
+}
+
+// fromTrustedProxy reports whether r originates from one of the Server's
+// TrustedProxies.
+func (s *Server) fromTrustedProxy(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
 		return false
 	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, n := range s.cfg.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// baseURL returns the absolute URL at which a client reached the Server,
+// without a path.  The scheme and host are those used by the client, or those
+// reported by a trusted reverse proxy.
+func (s *Server) baseURL(r *http.Request) url.URL {
+	u := url.URL{
+		Scheme: "http",
+		Host:   r.Host,
+	}
+	if r.TLS != nil {
+		u.Scheme = "https"
+	}
+
+	if s.fromTrustedProxy(r) {
+		if v := r.Header.Get("X-Forwarded-Proto"); v != "" {
+			u.Scheme = v
+		}
+		if v := r.Header.Get("X-Forwarded-Host"); v != "" {
+			u.Host = v
+		}
+	}
+
+	return u
 }
 
 // A requestContext is the requestContext for a request, parsed from the HTTP request.
@@ -206,30 +639,50 @@ type requestContext struct {
 	Password string
 	Token    string
 	Salt     string
+	APIKey   string
 	Client   string
 	Version  string
 
 	authMethod authMethod
 }
 
-// parseRequestContext parses parameters from a HTTP request into a requestContext.
-// If any mandatory parameters are missing, it returns false.
-func parseRequestContext(r *http.Request) (*requestContext, bool) {
-	q := r.URL.Query()
-
-	user := q.Get("u")
-	if user == "" {
-		return nil, false
-	}
+// parseRequestContext parses parameters from a HTTP request into a
+// requestContext.  The request's form must already be parsed.  If any
+// mandatory parameters are missing or conflict with each other, it returns a
+// function which writes the appropriate Subsonic error.
+func parseRequestContext(r *http.Request) (*requestContext, func(c *container)) {
+	q := r.Form
 
 	client := q.Get("c")
 	if client == "" {
-		return nil, false
+		return nil, errMissingParameter
 	}
 
 	version := q.Get("v")
 	if version == "" {
-		return nil, false
+		return nil, errMissingParameter
+	}
+
+	user := q.Get("u")
+
+	// API key identifies the user on its own, and must not be combined
+	// with any other authentication method
+	if key := q.Get("apiKey"); key != "" {
+		if user != "" || q.Get("p") != "" || q.Get("t") != "" || q.Get("s") != "" {
+			return nil, errConflictingAuth
+		}
+
+		return &requestContext{
+			APIKey:  key,
+			Client:  client,
+			Version: version,
+
+			authMethod: authMethodAPIKey,
+		}, nil
+	}
+
+	if user == "" {
+		return nil, errMissingParameter
 	}
 
 	// Password may be encoded, so transparently decode it, if needed
@@ -243,18 +696,18 @@ func parseRequestContext(r *http.Request) (*requestContext, bool) {
 			Version:  version,
 
 			authMethod: authMethodPassword,
-		}, true
+		}, nil
 	}
 
 	// If password was empty, check for newer token and salt method
 	token := q.Get("t")
 	if token == "" {
-		return nil, false
+		return nil, errMissingParameter
 	}
 
 	salt := q.Get("s")
 	if salt == "" {
-		return nil, false
+		return nil, errMissingParameter
 	}
 
 	// Token and salt not empty, authenticate using token and salt method
@@ -266,7 +719,7 @@ func parseRequestContext(r *http.Request) (*requestContext, bool) {
 		Version: version,
 
 		authMethod: authMethodTokenSalt,
-	}, true
+	}, nil
 }
 
 // decodePassword decodes a password, if necessary, from its encoded hex
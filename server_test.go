@@ -1,10 +1,16 @@
 package mpdsub
 
 import (
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/fhs/gompd/mpd"
 )
 
 func TestServerClose(t *testing.T) {
@@ -13,7 +19,7 @@ func TestServerClose(t *testing.T) {
 		pingC: pingC,
 	}
 
-	s := newServer(db, nil, &Config{
+	s := newServer([]*folder{newFolder(0, "", db, "")}, nil, &Config{
 		Keepalive: 10 * time.Millisecond,
 	})
 	for i := 0; i < 3; i++ {
@@ -167,6 +173,123 @@ func TestServerServeHTTP(t *testing.T) {
 
 			status: statusOK,
 		},
+		{
+			name: "client must upgrade",
+			cfg: &Config{
+				SubsonicUser:     "test",
+				SubsonicPassword: "test",
+			},
+
+			method: http.MethodGet,
+			target: "/rest/ping.view",
+
+			values: url.Values{
+				"u": []string{"test"},
+				"p": []string{"test"},
+				"c": []string{"test"},
+				"v": []string{"0.9.0"},
+			},
+
+			code:   codeClientVersion,
+			status: statusFailed,
+		},
+		{
+			name: "newer compatible version, 1.15.0",
+			cfg: &Config{
+				SubsonicUser:     "test",
+				SubsonicPassword: "test",
+			},
+
+			method: http.MethodGet,
+			target: "/rest/ping.view",
+
+			values: url.Values{
+				"u": []string{"test"},
+				"p": []string{"test"},
+				"c": []string{"test"},
+				"v": []string{"1.15.0"},
+			},
+
+			status: statusOK,
+		},
+		{
+			name: "newer compatible version, 1.16.1",
+			cfg: &Config{
+				SubsonicUser:     "test",
+				SubsonicPassword: "test",
+			},
+
+			method: http.MethodGet,
+			target: "/rest/ping.view",
+
+			values: url.Values{
+				"u": []string{"test"},
+				"p": []string{"test"},
+				"c": []string{"test"},
+				"v": []string{"1.16.1"},
+			},
+
+			status: statusOK,
+		},
+		{
+			name: "server must upgrade, major",
+			cfg: &Config{
+				SubsonicUser:     "test",
+				SubsonicPassword: "test",
+			},
+
+			method: http.MethodGet,
+			target: "/rest/ping.view",
+
+			values: url.Values{
+				"u": []string{"test"},
+				"p": []string{"test"},
+				"c": []string{"test"},
+				"v": []string{"2.0.0"},
+			},
+
+			code:   codeServerVersion,
+			status: statusFailed,
+		},
+		{
+			name: "older compatible version",
+			cfg: &Config{
+				SubsonicUser:     "test",
+				SubsonicPassword: "test",
+			},
+
+			method: http.MethodGet,
+			target: "/rest/ping.view",
+
+			values: url.Values{
+				"u": []string{"test"},
+				"p": []string{"test"},
+				"c": []string{"test"},
+				"v": []string{"1.2.0"},
+			},
+
+			status: statusOK,
+		},
+		{
+			name: "unknown route",
+			cfg: &Config{
+				SubsonicUser:     "test",
+				SubsonicPassword: "test",
+			},
+
+			method: http.MethodGet,
+			target: "/rest/foo.view",
+
+			values: url.Values{
+				"u": []string{"test"},
+				"p": []string{"test"},
+				"c": []string{"test"},
+				"v": []string{"1.14.0"},
+			},
+
+			code:   codeNotFound,
+			status: statusFailed,
+		},
 		{
 			name: "OK encoded password",
 			cfg: &Config{
@@ -206,6 +329,91 @@ func TestServerServeHTTP(t *testing.T) {
 
 			status: statusOK,
 		},
+		{
+			name: "OK API key",
+			cfg: &Config{
+				Users: []User{{
+					Name:    "test",
+					APIKeys: []string{HashAPIKey("sesame")},
+				}},
+			},
+
+			method: http.MethodGet,
+			target: "/rest/ping.view",
+
+			values: url.Values{
+				"apiKey": []string{"sesame"},
+				"c":      []string{"test"},
+				"v":      []string{"1.14.0"},
+			},
+
+			status: statusOK,
+		},
+		{
+			name: "invalid API key",
+			cfg: &Config{
+				Users: []User{{
+					Name:    "test",
+					APIKeys: []string{HashAPIKey("sesame")},
+				}},
+			},
+
+			values: url.Values{
+				"apiKey": []string{"foo"},
+				"c":      []string{"test"},
+				"v":      []string{"1.14.0"},
+			},
+
+			code:   codeInvalidAPIKey,
+			status: statusFailed,
+		},
+		{
+			name: "API key with username",
+
+			values: url.Values{
+				"apiKey": []string{"sesame"},
+				"u":      []string{"test"},
+				"c":      []string{"test"},
+				"v":      []string{"1.14.0"},
+			},
+
+			code:   codeConflictingAuth,
+			status: statusFailed,
+		},
+		{
+			name: "API key with token",
+
+			values: url.Values{
+				"apiKey": []string{"sesame"},
+				"t":      []string{"test"},
+				"s":      []string{"test"},
+				"c":      []string{"test"},
+				"v":      []string{"1.14.0"},
+			},
+
+			code:   codeConflictingAuth,
+			status: statusFailed,
+		},
+		{
+			name: "token for user without password",
+			cfg: &Config{
+				Users: []User{{
+					Name:    "test",
+					APIKeys: []string{HashAPIKey("sesame")},
+				}},
+			},
+
+			values: url.Values{
+				"u": []string{"test"},
+				"t": []string{"ff0792d8c345da74a596a357fe35bd90"},
+				"s": []string{"c19b2d"},
+				"c": []string{"test"},
+				"v": []string{"1.14.0"},
+			},
+
+			code:   codeTokenAuthNotSupported,
+			status: statusFailed,
+		},
 	}
 
 	for _, tt := range tests {
@@ -236,3 +444,476 @@ func TestServerServeHTTP(t *testing.T) {
 		})
 	}
 }
+
+func TestServerRoles(t *testing.T) {
+	db := &memoryDatabase{
+		files: []string{"a.mp3"},
+		attrs: map[string]mpd.Attrs{
+			"a.mp3": {},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		roles Role
+
+		target string
+		kv     []string
+
+		status   string
+		code     int
+		mirrored bool
+	}{
+		{
+			name:   "ping, no roles",
+			target: "/rest/ping.view",
+			status: statusOK,
+		},
+		{
+			name:   "stream, no roles",
+			target: "/rest/stream.view",
+			status: statusFailed,
+			code:   codeNotAuthorized,
+		},
+		{
+			name:   "stream, download role",
+			roles:  RoleDownload,
+			target: "/rest/stream.view",
+			status: statusFailed,
+			code:   codeNotAuthorized,
+		},
+		{
+			name:   "stream, stream role",
+			roles:  RoleStream,
+			target: "/rest/stream.view",
+			status: statusFailed,
+			code:   codeMissingParameter,
+		},
+		{
+			name:   "stream, admin role",
+			roles:  RoleAdmin,
+			target: "/rest/stream.view",
+			status: statusFailed,
+			code:   codeMissingParameter,
+		},
+		{
+			name:   "cover art, stream role",
+			roles:  RoleStream,
+			target: "/rest/getCoverArt.view",
+			status: statusFailed,
+			code:   codeNotAuthorized,
+		},
+		{
+			name:   "cover art, cover art role",
+			roles:  RoleCoverArt,
+			target: "/rest/getCoverArt.view",
+			status: statusFailed,
+			code:   codeMissingParameter,
+		},
+		{
+			name:   "save play queue, stream role",
+			roles:  RoleStream,
+			target: "/rest/savePlayQueue.view",
+			kv:     []string{"id", "0"},
+			status: statusOK,
+		},
+		{
+			name:     "save play queue, jukebox role",
+			roles:    RoleJukebox,
+			target:   "/rest/savePlayQueue.view",
+			kv:       []string{"id", "0"},
+			status:   statusOK,
+			mirrored: true,
+		},
+		{
+			name:   "create radio station, jukebox role",
+			roles:  RoleJukebox,
+			target: "/rest/createInternetRadioStation.view",
+			status: statusFailed,
+			code:   codeNotAuthorized,
+		},
+		{
+			name:   "create radio station, admin role",
+			roles:  RoleAdmin,
+			target: "/rest/createInternetRadioStation.view",
+			status: statusFailed,
+			code:   codeMissingParameter,
+		},
+		{
+			name:   "update radio station, jukebox role",
+			roles:  RoleJukebox,
+			target: "/rest/updateInternetRadioStation.view",
+			status: statusFailed,
+			code:   codeNotAuthorized,
+		},
+		{
+			name:   "update radio station, admin role",
+			roles:  RoleAdmin,
+			target: "/rest/updateInternetRadioStation.view",
+			status: statusFailed,
+			code:   codeMissingParameter,
+		},
+		{
+			name:   "delete radio station, jukebox role",
+			roles:  RoleJukebox,
+			target: "/rest/deleteInternetRadioStation.view",
+			status: statusFailed,
+			code:   codeNotAuthorized,
+		},
+		{
+			name:   "delete radio station, admin role",
+			roles:  RoleAdmin,
+			target: "/rest/deleteInternetRadioStation.view",
+			status: statusFailed,
+			code:   codeMissingParameter,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &memoryPlayer{}
+
+			cfg, _ := configAuth()
+			cfg.Player = p
+			cfg.Users = []User{{
+				Name:     "user",
+				Password: "user",
+				Roles:    tt.roles,
+			}}
+
+			withServer(t, db, nil, cfg, func(base string) {
+				c := testUserRequest(t, base, "user", tt.target, tt.kv...)
+
+				if want, got := tt.status, c.Status; want != got {
+					t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+				}
+
+				if c.Error != nil {
+					if want, got := tt.code, c.Error.Code; want != got {
+						t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+					}
+				}
+
+				if want, got := tt.mirrored, p.clears > 0; want != got {
+					t.Fatalf("unexpected play queue mirroring:\n- want: %v\n-  got: %v", want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServerProxyAuthentication(t *testing.T) {
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("failed to parse CIDR: %v", err)
+	}
+	_, other, err := net.ParseCIDR("192.0.2.0/24")
+	if err != nil {
+		t.Fatalf("failed to parse CIDR: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		trusted []*net.IPNet
+		user    string
+
+		status string
+		code   int
+	}{
+		{
+			name:    "trusted proxy, known user",
+			trusted: []*net.IPNet{loopback},
+			user:    "test",
+			status:  statusOK,
+		},
+		{
+			name:    "trusted proxy, unknown user",
+			trusted: []*net.IPNet{loopback},
+			user:    "foo",
+			status:  statusFailed,
+			code:    codeUnauthorized,
+		},
+		{
+			name:    "untrusted proxy",
+			trusted: []*net.IPNet{other},
+			user:    "test",
+			status:  statusFailed,
+			code:    codeMissingParameter,
+		},
+		{
+			name:    "trusted proxy, no header",
+			trusted: []*net.IPNet{loopback},
+			status:  statusFailed,
+			code:    codeMissingParameter,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Users: []User{{
+					Name: "test",
+				}},
+				ProxyAuthHeader: "X-Forwarded-User",
+				TrustedProxies:  tt.trusted,
+			}
+
+			withServer(t, nil, nil, cfg, func(base string) {
+				req, err := http.NewRequest(http.MethodGet, base+"/rest/ping.view", nil)
+				if err != nil {
+					t.Fatalf("failed to create HTTP request: %v", err)
+				}
+				if tt.user != "" {
+					req.Header.Set("X-Forwarded-User", tt.user)
+				}
+
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("failed to perform HTTP request: %v", err)
+				}
+
+				c := mustDecodeXML(t, res)
+
+				if want, got := tt.status, c.Status; want != got {
+					t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+				}
+
+				if c.Error != nil {
+					if want, got := tt.code, c.Error.Code; want != got {
+						t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestServerFormPost(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	db := &memoryDatabase{
+		files: []string{"foo.mp3"},
+	}
+	fs := &memoryFilesystem{
+		files: map[string]*memoryFile{
+			filepath.Join(musicDirectory, "foo.mp3"): &memoryFile{
+				ReadSeeker: strings.NewReader(`hello`),
+			},
+		},
+	}
+
+	cfg, auth := configAuth()
+	cfg.MusicDirectory = musicDirectory
+
+	tests := []struct {
+		name   string
+		target string
+		query  url.Values
+		form   url.Values
+
+		status string
+		code   int
+		body   string
+	}{
+		{
+			name:   "credentials in body",
+			target: "/rest/ping.view",
+			form:   auth,
+			status: statusOK,
+		},
+		{
+			name:   "wrong password in body",
+			target: "/rest/ping.view",
+			form: url.Values{
+				"u": []string{"test"},
+				"p": []string{"wrong"},
+				"c": []string{"test"},
+				"v": []string{"1.14.0"},
+			},
+			status: statusFailed,
+			code:   codeUnauthorized,
+		},
+		{
+			name:   "credentials in query, ID in body",
+			target: "/rest/stream.view",
+			query:  auth,
+			form: url.Values{
+				"id": []string{"0"},
+			},
+			body: "hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withServer(t, db, fs, cfg, func(base string) {
+				res := testFormRequest(t, base, tt.target, tt.query, tt.form)
+
+				if tt.body != "" {
+					b, err := ioutil.ReadAll(res.Body)
+					if err != nil {
+						t.Fatalf("failed to read body: %v", err)
+					}
+					_ = res.Body.Close()
+
+					if want, got := tt.body, string(b); want != got {
+						t.Fatalf("unexpected body:\n- want: %q\n-  got: %q", want, got)
+					}
+
+					return
+				}
+
+				c := mustDecodeXML(t, res)
+
+				if want, got := tt.status, c.Status; want != got {
+					t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+				}
+
+				if c.Error != nil {
+					if want, got := tt.code, c.Error.Code; want != got {
+						t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestServerRoutes(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		format string
+
+		status string
+		code   int
+	}{
+		{
+			name:   "view suffix",
+			target: "/rest/ping.view",
+			status: statusOK,
+		},
+		{
+			name:   "no view suffix",
+			target: "/rest/ping",
+			status: statusOK,
+		},
+		{
+			name:   "trailing slash",
+			target: "/rest/ping/",
+			status: statusOK,
+		},
+		{
+			name:   "view suffix, trailing slash",
+			target: "/rest/ping.view/",
+			status: statusOK,
+		},
+		{
+			name:   "unknown method",
+			target: "/rest/foo.view",
+			status: statusFailed,
+			code:   codeNotFound,
+		},
+		{
+			name:   "JSON",
+			target: "/rest/ping",
+			format: formatJSON,
+			status: statusOK,
+		},
+		{
+			name:   "JSON, unknown method",
+			target: "/rest/foo",
+			format: formatJSON,
+			status: statusFailed,
+			code:   codeNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, values := configAuth()
+			if tt.format != "" {
+				values.Set("f", tt.format)
+			}
+
+			withServer(t, nil, nil, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, tt.target, values)
+
+				var c container
+				if tt.format == formatJSON {
+					c = mustDecodeJSON(t, res)
+				} else {
+					c = mustDecodeXML(t, res)
+				}
+
+				if want, got := tt.status, c.Status; want != got {
+					t.Fatalf("unexpected Status:\n- want: %q\n-  got: %q", want, got)
+				}
+
+				if c.Error != nil {
+					if want, got := tt.code, c.Error.Code; want != got {
+						t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestServerJSONP(t *testing.T) {
+	body := `{"subsonic-response":{"status":"ok","version":"` + apiVersion +
+		`","type":"` + serverType + `","serverVersion":"` + serverVersion +
+		`","openSubsonic":true}}` + "\n"
+
+	tests := []struct {
+		name     string
+		callback string
+		ct       string
+		body     string
+	}{
+		{
+			name:     "callback",
+			callback: "cb",
+			ct:       contentTypeJSONP,
+			body:     "cb(" + body + ");",
+		},
+		{
+			name:     "namespaced callback",
+			callback: "jQuery.cb_1",
+			ct:       contentTypeJSONP,
+			body:     "jQuery.cb_1(" + body + ");",
+		},
+		{
+			name:     "malicious callback",
+			callback: "alert(document.cookie)//",
+			ct:       contentTypeJSON,
+			body:     body,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, values := configAuth()
+			values.Set("f", formatJSONP)
+			values.Set("callback", tt.callback)
+
+			withServer(t, nil, nil, cfg, func(base string) {
+				res := testRequest(t, base, http.MethodGet, "/rest/ping.view", values)
+
+				if want, got := tt.ct, res.Header.Get(contentType); want != got {
+					t.Fatalf("unexpected Content-Type:\n- want: %q\n-  got: %q", want, got)
+				}
+
+				b, err := ioutil.ReadAll(res.Body)
+				if err != nil {
+					t.Fatalf("failed to read body: %v", err)
+				}
+				_ = res.Body.Close()
+
+				if want, got := tt.body, string(b); want != got {
+					t.Fatalf("unexpected body:\n- want: %q\n-  got: %q", want, got)
+				}
+			})
+		})
+	}
+}
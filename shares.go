@@ -0,0 +1,555 @@
+package mpdsub
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sharePrefix is the URL path prefix of public share pages, which are served
+// without Subsonic credentials.
+const sharePrefix = "/share/"
+
+// A share is a set of files and directories which a user has shared with
+// anyone who has the share's link.  A zero Expires time indicates that the
+// share never expires.
+type share struct {
+	ID          string    `json:"id"`
+	User        string    `json:"user"`
+	Description string    `json:"description,omitempty"`
+	Entries     []fileRef `json:"entries"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+	LastVisited time.Time `json:"lastVisited"`
+	VisitCount  int       `json:"visitCount,omitempty"`
+}
+
+// expired reports whether the share has expired at time now.
+func (sh share) expired(now time.Time) bool {
+	return !sh.Expires.IsZero() && !now.Before(sh.Expires)
+}
+
+// A sharedFile is a file which belongs to a share.
+type sharedFile struct {
+	folder *folder
+	file   metadataFile
+}
+
+// shareFiles returns the files shared by sh, as seen by its owner u.  Shared
+// directories are expanded into all of the files beneath them.  Files which
+// no longer exist, or which u can no longer access, are omitted.
+func (s *Server) shareFiles(u *User, sh share) ([]sharedFile, error) {
+	// Index each folder at most once, no matter how many entries refer
+	// to it
+	indexes := make(map[int][]indexedFile)
+
+	type key struct{ folder, id int }
+	seen := make(map[key]bool)
+
+	var out []sharedFile
+	for _, ref := range sh.Entries {
+		folder, ok := s.lookupFolder(ref.Folder)
+		if !ok {
+			continue
+		}
+
+		files, ok := indexes[folder.ID]
+		if !ok {
+			var err error
+			files, err = folder.index()
+			if err != nil {
+				return nil, err
+			}
+
+			indexes[folder.ID] = files
+		}
+
+		var matched []indexedFile
+		for _, f := range visibleFiles(u, files) {
+			if f.Dir || seen[key{folder.ID, f.ID}] {
+				continue
+			}
+
+			if sharesName(ref, f.Name) {
+				seen[key{folder.ID, f.ID}] = true
+				matched = append(matched, f)
+			}
+		}
+
+		tagged, err := tagFiles(folder.db, matched)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range tagged {
+			out = append(out, sharedFile{folder: folder, file: f})
+		}
+	}
+
+	return out, nil
+}
+
+// newShareElement creates a shareElement for sh, including its files.
+func (s *Server) newShareElement(r *http.Request, sh share) (shareElement, error) {
+	e := shareElement{
+		ID:          sh.ID,
+		URL:         s.shareURL(r, sh.ID),
+		Description: sh.Description,
+		Username:    sh.User,
+		Created:     sh.Created,
+		VisitCount:  sh.VisitCount,
+	}
+	if !sh.Expires.IsZero() {
+		e.Expires = &sh.Expires
+	}
+	if !sh.LastVisited.IsZero() {
+		e.LastVisited = &sh.LastVisited
+	}
+
+	// The owner may have been removed from the configuration since the
+	// share was created, in which case nothing is shared
+	u, ok := s.users[sh.User]
+	if !ok {
+		return e, nil
+	}
+
+	files, err := s.shareFiles(u, sh)
+	if err != nil {
+		return shareElement{}, err
+	}
+
+	for _, f := range files {
+		e.Entries = append(e.Entries, newChild(f.folder, f.file))
+	}
+
+	return e, nil
+}
+
+// shareURL returns the absolute URL of the public page for the share with
+// the input ID.
+func (s *Server) shareURL(r *http.Request, id string) string {
+	u := s.baseURL(r)
+	u.Path = sharePrefix + id
+
+	return u.String()
+}
+
+// createShare shares one or more files or directories, specified using
+// repeated id parameters, for the requesting user.  The optional expires
+// parameter is a time in milliseconds since the Unix epoch.
+func (s *Server) createShare(w http.ResponseWriter, r *http.Request) {
+	ids := r.Form["id"]
+	if len(ids) == 0 {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	expires, ok := parseExpires(w, r)
+	if !ok {
+		return
+	}
+
+	refs := make([]fileRef, 0, len(ids))
+	for _, qID := range ids {
+		folder, _, file, ok := s.lookupItem(w, r, qID)
+		if !ok {
+			return
+		}
+
+		refs = append(refs, fileRef{Folder: folder.ID, Name: file.Name})
+	}
+
+	id, err := newShareID()
+	if err != nil {
+		s.logf("error generating share ID: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	sh := share{
+		ID:          id,
+		User:        requestUser(r).Name,
+		Description: r.Form.Get("description"),
+		Entries:     refs,
+		Created:     time.Now(),
+		Expires:     expires,
+	}
+
+	if err := s.state.update(func(st *state) {
+		st.Shares = append(st.Shares, sh)
+	}); err != nil {
+		s.logf("error creating share: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	e, err := s.newShareElement(r, sh)
+	if err != nil {
+		s.logf("error listing shared files: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	writeXML(w, func(c *container) {
+		c.Shares = &sharesContainer{
+			Shares: []shareElement{e},
+		}
+	})
+}
+
+// getShares returns the shares created by the requesting user.
+func (s *Server) getShares(w http.ResponseWriter, r *http.Request) {
+	u := requestUser(r)
+
+	var shares []share
+	s.state.view(func(st *state) {
+		for _, sh := range st.Shares {
+			if sh.User == u.Name {
+				shares = append(shares, sh)
+			}
+		}
+	})
+
+	out := make([]shareElement, 0, len(shares))
+	for _, sh := range shares {
+		e, err := s.newShareElement(r, sh)
+		if err != nil {
+			s.logf("error listing shared files: %v", err)
+			writeXML(w, errGeneric)
+			return
+		}
+
+		out = append(out, e)
+	}
+
+	writeXML(w, func(c *container) {
+		c.Shares = &sharesContainer{
+			Shares: out,
+		}
+	})
+}
+
+// updateShare updates the description and expiry time of a share created by
+// the requesting user.  Parameters which are not set are left unchanged, and
+// an expires parameter of 0 removes the expiry time.
+func (s *Server) updateShare(w http.ResponseWriter, r *http.Request) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	expires, ok := parseExpires(w, r)
+	if !ok {
+		return
+	}
+
+	u := requestUser(r)
+
+	var found bool
+	err := s.state.update(func(st *state) {
+		for i := range st.Shares {
+			sh := &st.Shares[i]
+			if sh.ID != qID || sh.User != u.Name {
+				continue
+			}
+			found = true
+
+			if _, ok := r.Form["description"]; ok {
+				sh.Description = r.Form.Get("description")
+			}
+			if _, ok := r.Form["expires"]; ok {
+				sh.Expires = expires
+			}
+			return
+		}
+	})
+	if err != nil {
+		s.logf("error updating share: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+	if !found {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	writeXML(w, nil)
+}
+
+// deleteShare deletes a share created by the requesting user.
+func (s *Server) deleteShare(w http.ResponseWriter, r *http.Request) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	u := requestUser(r)
+
+	var found bool
+	err := s.state.update(func(st *state) {
+		for i := range st.Shares {
+			if st.Shares[i].ID == qID && st.Shares[i].User == u.Name {
+				st.Shares = append(st.Shares[:i], st.Shares[i+1:]...)
+				found = true
+				return
+			}
+		}
+	})
+	if err != nil {
+		s.logf("error deleting share: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+	if !found {
+		writeXML(w, errNotFound)
+		return
+	}
+
+	writeXML(w, nil)
+}
+
+// parseExpires parses the optional expires parameter from a request.  If
+// the parameter is invalid, an error is written to w and parseExpires
+// returns false.
+func parseExpires(w http.ResponseWriter, r *http.Request) (time.Time, bool) {
+	qExpires := r.Form.Get("expires")
+	if qExpires == "" {
+		return time.Time{}, true
+	}
+
+	ms, err := strconv.ParseInt(qExpires, 10, 64)
+	if err != nil || ms < 0 {
+		writeXML(w, errGeneric)
+		return time.Time{}, false
+	}
+	if ms == 0 {
+		return time.Time{}, true
+	}
+
+	return time.Unix(0, ms*int64(time.Millisecond)), true
+}
+
+// newShareID generates a random ID for a share.  Share IDs appear in public
+// links, so they must not be guessable.
+func newShareID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// serveShare serves the public page for a share at /share/<id>, and streams
+// the share's files at /share/<id>/stream.  Requests are served as the
+// share's owner, but only for files which belong to the share.
+func (s *Server) serveShare(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, sharePrefix)
+
+	var action string
+	if i := strings.IndexByte(id, '/'); i != -1 {
+		id, action = id[:i], id[i+1:]
+	}
+
+	if action != "" && action != "stream" {
+		http.NotFound(w, r)
+		return
+	}
+
+	sh, u, ok := s.visitShare(id, action == "")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	if action == "" {
+		files, err := s.shareFiles(u, sh)
+		if err != nil {
+			s.logf("error listing shared files: %v", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		s.sharePage(w, sh, files)
+		return
+	}
+
+	if !u.can(RoleStream) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Only stream files which belong to the share, even though the owner
+	// may be able to access others
+	ok, err := s.shareContains(u, sh, r.Form.Get("id"))
+	if err != nil {
+		s.logf("error listing files from mpd for shared stream: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.stream(w, withUser(r, u))
+}
+
+// shareContains determines if the file with the input ID is one of the files
+// in a share which u may access.  Unlike shareFiles, files are not tagged, so
+// it is cheap enough to call for each streamed file.
+func (s *Server) shareContains(u *User, sh share, qID string) (bool, error) {
+	fid, id, err := parseID(qID)
+	if err != nil {
+		return false, nil
+	}
+
+	folder, ok := s.lookupFolder(fid)
+	if !ok {
+		return false, nil
+	}
+
+	files, err := folder.index()
+	if err != nil {
+		return false, err
+	}
+
+	f, ok := lookupFile(u, files, id)
+	if !ok || f.Dir {
+		return false, nil
+	}
+
+	for _, ref := range sh.Entries {
+		if ref.Folder == folder.ID && sharesName(ref, f.Name) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// sharesName determines if a share entry refers to the file with the input
+// name, or to a directory which contains it.
+func sharesName(ref fileRef, name string) bool {
+	return name == ref.Name || strings.HasPrefix(name, ref.Name+string(os.PathSeparator))
+}
+
+// visitShare returns the unexpired share with the input ID and its owner.
+// If record is true, the visit is recorded in the share.
+func (s *Server) visitShare(id string, record bool) (share, *User, bool) {
+	var (
+		sh    share
+		found bool
+	)
+
+	now := time.Now()
+	fn := func(st *state) {
+		for i := range st.Shares {
+			if st.Shares[i].ID != id || st.Shares[i].expired(now) {
+				continue
+			}
+
+			if record {
+				st.Shares[i].LastVisited = now
+				st.Shares[i].VisitCount++
+			}
+
+			sh, found = st.Shares[i], true
+			return
+		}
+	}
+
+	if record {
+		if err := s.state.update(fn); err != nil {
+			// A visit which cannot be recorded should not prevent it
+			s.logf("error recording share visit: %v", err)
+		}
+	} else {
+		s.state.view(fn)
+	}
+	if !found {
+		return share{}, nil, false
+	}
+
+	u, ok := s.users[sh.User]
+	if !ok {
+		return share{}, nil, false
+	}
+
+	return sh, u, true
+}
+
+// sharePageTemplate is the HTML page for a share, which plays each of its
+// files in the browser.
+var sharePageTemplate = template.Must(template.New("share").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>Shared by {{.User}}{{if .Expires}}, until {{.Expires}}{{end}}</p>
+<ol>
+{{range .Entries}}<li>
+<p>{{.Title}}</p>
+<audio controls preload="none" src="{{.Stream}}"></audio>
+</li>
+{{end}}</ol>
+</body>
+</html>
+`))
+
+// sharePage writes the HTML page for sh, which lists its files.
+func (s *Server) sharePage(w http.ResponseWriter, sh share, files []sharedFile) {
+	type entry struct {
+		Title  string
+		Stream string
+	}
+
+	data := struct {
+		Title   string
+		User    string
+		Expires string
+		Entries []entry
+	}{
+		Title: sh.Description,
+		User:  sh.User,
+	}
+	if data.Title == "" {
+		data.Title = "Shared music"
+	}
+	if !sh.Expires.IsZero() {
+		data.Expires = sh.Expires.UTC().Format(time.RFC1123)
+	}
+
+	for _, f := range files {
+		title := f.file.Title
+		if title == "" {
+			title = filepath.Base(f.file.Name)
+		}
+		if f.file.Artist != "" {
+			title = f.file.Artist + " - " + title
+		}
+
+		data.Entries = append(data.Entries, entry{
+			Title:  title,
+			Stream: sharePrefix + url.PathEscape(sh.ID) + "/stream?id=" + url.QueryEscape(formatID(f.folder.ID, f.file.ID)),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := sharePageTemplate.Execute(w, data); err != nil {
+		s.logf("error writing share page: %v", err)
+	}
+}
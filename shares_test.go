@@ -0,0 +1,179 @@
+package mpdsub
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+func TestServerShares(t *testing.T) {
+	const musicDirectory = "/var/music"
+
+	db := &memoryDatabase{
+		files: []string{"Album/a.mp3", "Album/b.mp3", "Other/c.mp3"},
+		attrs: map[string]mpd.Attrs{
+			"Album/a.mp3": {"ARTIST": "Artist", "TITLE": "A"},
+			"Album/b.mp3": {"ARTIST": "Artist", "TITLE": "B"},
+			"Other/c.mp3": {"TITLE": "C"},
+		},
+	}
+
+	fs := &memoryFilesystem{
+		files: map[string]*memoryFile{
+			filepath.Join(musicDirectory, "Album/a.mp3"): &memoryFile{
+				ReadSeeker: strings.NewReader("a"),
+			},
+			filepath.Join(musicDirectory, "Other/c.mp3"): &memoryFile{
+				ReadSeeker: strings.NewReader("c"),
+			},
+		},
+	}
+
+	cfg := &Config{
+		MusicDirectory: musicDirectory,
+		Users: []User{
+			{Name: "alice", Password: "alice", Roles: RoleShare | RoleStream},
+			{Name: "bob", Password: "bob", Roles: RoleShare},
+			{Name: "carol", Password: "carol", Roles: RoleStream},
+		},
+	}
+
+	withServer(t, db, fs, cfg, func(base string) {
+		errCode := func(c container) int {
+			if c.Error == nil {
+				return 0
+			}
+
+			return c.Error.Code
+		}
+
+		get := func(target string) (int, string) {
+			res, err := http.Get(base + target)
+			if err != nil {
+				t.Fatalf("failed to perform HTTP request: %v", err)
+			}
+			defer res.Body.Close()
+
+			b, err := ioutil.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("failed to read HTTP response: %v", err)
+			}
+
+			return res.StatusCode, string(b)
+		}
+
+		if want, got := codeNotAuthorized, errCode(testUserRequest(t, base, "carol", "/rest/createShare.view", "id", "0")); want != got {
+			t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		c := testUserRequest(t, base, "alice", "/rest/createShare.view", "id", "0", "id", "1", "description", "An album")
+		if c.Error != nil {
+			t.Fatalf("unexpected error: %+v", c.Error)
+		}
+
+		sh := c.Shares.Shares[0]
+		if want, got := "An album", sh.Description; want != got {
+			t.Fatalf("unexpected description:\n- want: %q\n-  got: %q", want, got)
+		}
+		if want, got := base+sharePrefix+sh.ID, sh.URL; want != got {
+			t.Fatalf("unexpected share URL:\n- want: %q\n-  got: %q", want, got)
+		}
+
+		var ids []string
+		for _, e := range sh.Entries {
+			ids = append(ids, e.ID)
+		}
+		if want, got := []string{"1", "2"}, ids; !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected share entries:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		if want, got := 0, len(testUserRequest(t, base, "bob", "/rest/getShares.view").Shares.Shares); want != got {
+			t.Fatalf("unexpected number of shares for other user:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		code, body := get(sharePrefix + sh.ID)
+		if want, got := http.StatusOK, code; want != got {
+			t.Fatalf("unexpected share page status:\n- want: %v\n-  got: %v", want, got)
+		}
+		for _, s := range []string{"An album", "Artist - A", "stream?id=2"} {
+			if !strings.Contains(body, s) {
+				t.Fatalf("share page does not contain %q:\n%s", s, body)
+			}
+		}
+
+		streamTests := []struct {
+			name   string
+			target string
+			code   int
+			body   string
+		}{
+			{
+				name:   "shared",
+				target: sharePrefix + sh.ID + "/stream?id=1",
+				code:   http.StatusOK,
+				body:   "a",
+			},
+			{
+				name:   "not shared",
+				target: sharePrefix + sh.ID + "/stream?id=4",
+				code:   http.StatusNotFound,
+			},
+			{
+				name:   "unknown share",
+				target: sharePrefix + "foo/stream?id=1",
+				code:   http.StatusNotFound,
+			},
+			{
+				name:   "Subsonic API",
+				target: sharePrefix + sh.ID + "/../../rest/stream?id=4",
+				code:   http.StatusOK,
+				body:   `code="10"`,
+			},
+		}
+
+		for _, tt := range streamTests {
+			t.Run(tt.name, func(t *testing.T) {
+				code, body := get(tt.target)
+				if want, got := tt.code, code; want != got {
+					t.Fatalf("unexpected HTTP status:\n- want: %v\n-  got: %v", want, got)
+				}
+				if tt.body != "" && !strings.Contains(body, tt.body) {
+					t.Fatalf("unexpected body:\n- want: %q\n-  got: %q", tt.body, body)
+				}
+			})
+		}
+
+		c = testUserRequest(t, base, "alice", "/rest/getShares.view")
+		if want, got := 1, c.Shares.Shares[0].VisitCount; want != got {
+			t.Fatalf("unexpected visit count:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		if want, got := codeNotFound, errCode(testUserRequest(t, base, "bob", "/rest/deleteShare.view", "id", sh.ID)); want != got {
+			t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		// Expire the share, so that its page is no longer served
+		past := strconv.FormatInt(time.Now().Add(-1*time.Hour).UnixNano()/int64(time.Millisecond), 10)
+		if want, got := 0, errCode(testUserRequest(t, base, "alice", "/rest/updateShare.view", "id", sh.ID, "expires", past)); want != got {
+			t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+		}
+
+		if code, _ := get(sharePrefix + sh.ID); code != http.StatusNotFound {
+			t.Fatalf("expected expired share to be not found, but got HTTP %d", code)
+		}
+
+		if want, got := 0, errCode(testUserRequest(t, base, "alice", "/rest/deleteShare.view", "id", sh.ID)); want != got {
+			t.Fatalf("unexpected error code:\n- want: %v\n-  got: %v", want, got)
+		}
+		if want, got := 0, len(testUserRequest(t, base, "alice", "/rest/getShares.view").Shares.Shares); want != got {
+			t.Fatalf("unexpected number of shares:\n- want: %v\n-  got: %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,370 @@
+package mpdsub
+
+import (
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultSongCount is the number of songs returned by getSimilarSongs and
+// getTopSongs when no count parameter is specified.
+const defaultSongCount = 50
+
+// Weights given to each tag which a song shares with the songs it is
+// compared against, when finding similar songs.
+const (
+	weightArtist      = 4
+	weightAlbumArtist = 3
+	weightGenre       = 2
+	weightYear        = 1
+
+	// yearRange is the maximum difference in years between songs which
+	// are considered to share a year.
+	yearRange = 5
+)
+
+// A song is a file along with the tags used to relate it to other files.
+type song struct {
+	fileRef
+
+	Artist      string
+	AlbumArtist string
+	Genre       string
+	Year        int
+}
+
+// listSongs returns every song which u may access, across all folders.
+func (s *Server) listSongs(u *User) ([]song, error) {
+	var out []song
+	for _, f := range s.folders {
+		// Tags for the whole folder are listed with a single request, rather
+		// than indexing the folder and requesting tags for each file
+		infos, err := f.db.ListAllInfo("")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, info := range infos {
+			name := info["file"]
+			if name == "" || isRemoteURI(name) || !u.allowed(name) {
+				continue
+			}
+
+			out = append(out, song{
+				fileRef:     fileRef{Folder: f.ID, Name: name},
+				Artist:      info["Artist"],
+				AlbumArtist: info["AlbumArtist"],
+				Genre:       info["Genre"],
+				Year:        parseYear(info["Date"]),
+			})
+		}
+	}
+
+	return out, nil
+}
+
+// parseYear parses the year from an MPD Date tag, such as "2006-01-02".  It
+// returns 0 if the tag has no year.
+func parseYear(date string) int {
+	if len(date) < 4 {
+		return 0
+	}
+
+	year, err := strconv.Atoi(date[:4])
+	if err != nil {
+		return 0
+	}
+
+	return year
+}
+
+// A songProfile is the set of tags of one or more songs, against which other
+// songs are compared.
+type songProfile struct {
+	artists      map[string]bool
+	albumArtists map[string]bool
+	genres       map[string]bool
+	years        []int
+}
+
+// newSongProfile creates a songProfile from the tags of songs.  Tags are
+// compared without regard to case.
+func newSongProfile(songs []song) songProfile {
+	p := songProfile{
+		artists:      make(map[string]bool),
+		albumArtists: make(map[string]bool),
+		genres:       make(map[string]bool),
+	}
+
+	for _, sg := range songs {
+		if sg.Artist != "" {
+			p.artists[strings.ToLower(sg.Artist)] = true
+		}
+		if sg.AlbumArtist != "" {
+			p.albumArtists[strings.ToLower(sg.AlbumArtist)] = true
+		}
+		if sg.Genre != "" {
+			p.genres[strings.ToLower(sg.Genre)] = true
+		}
+		if sg.Year != 0 {
+			p.years = append(p.years, sg.Year)
+		}
+	}
+
+	return p
+}
+
+// score determines how similar sg is to the songs in the profile.  A score
+// of 0 indicates that sg shares no tags with them.
+func (p songProfile) score(sg song) int {
+	var score int
+	if p.artists[strings.ToLower(sg.Artist)] {
+		score += weightArtist
+	}
+	if p.albumArtists[strings.ToLower(sg.AlbumArtist)] {
+		score += weightAlbumArtist
+	}
+	if p.genres[strings.ToLower(sg.Genre)] {
+		score += weightGenre
+	}
+
+	if sg.Year != 0 {
+		for _, y := range p.years {
+			if d := sg.Year - y; d >= -yearRange && d <= yearRange {
+				score += weightYear
+				break
+			}
+		}
+	}
+
+	return score
+}
+
+// getSimilarSongs returns songs which are similar to a song, or to all of the
+// songs beneath a directory, based on their tags.
+func (s *Server) getSimilarSongs(w http.ResponseWriter, r *http.Request) {
+	songs, ok := s.similarSongs(w, r)
+	if !ok {
+		return
+	}
+
+	writeXML(w, func(c *container) {
+		c.SimilarSongs = &songsContainer{
+			Songs: songs,
+		}
+	})
+}
+
+// getSimilarSongs2 returns songs which are similar to a song, or to all of
+// the songs beneath a directory.  Items are identified by the same IDs as
+// getSimilarSongs, because the Server does not organize files by their tags.
+func (s *Server) getSimilarSongs2(w http.ResponseWriter, r *http.Request) {
+	songs, ok := s.similarSongs(w, r)
+	if !ok {
+		return
+	}
+
+	writeXML(w, func(c *container) {
+		c.SimilarSongs2 = &songsContainer{
+			Songs: songs,
+		}
+	})
+}
+
+// similarSongs finds the songs which are most similar to the item specified
+// by the id parameter, up to the count parameter.  Songs which are equally
+// similar are ordered by play count.  If a parameter is invalid, an error is
+// written to w and similarSongs returns false.
+func (s *Server) similarSongs(w http.ResponseWriter, r *http.Request) ([]child, bool) {
+	qID := r.Form.Get("id")
+	if qID == "" {
+		writeXML(w, errMissingParameter)
+		return nil, false
+	}
+
+	count, ok := parseSongCount(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	folder, _, item, ok := s.lookupItem(w, r, qID)
+	if !ok {
+		return nil, false
+	}
+
+	u := requestUser(r)
+	all, err := s.listSongs(u)
+	if err != nil {
+		s.logf("error listing files from mpd for getting similar songs: %v", err)
+		writeXML(w, errGeneric)
+		return nil, false
+	}
+
+	// The item itself, or every song beneath it, is compared against all
+	// other songs
+	isSeed := func(sg song) bool {
+		if sg.Folder != folder.ID {
+			return false
+		}
+		if !item.Dir {
+			return sg.Name == item.Name
+		}
+
+		return strings.HasPrefix(sg.Name, item.Name+string(os.PathSeparator))
+	}
+
+	var seeds, candidates []song
+	for _, sg := range all {
+		if isSeed(sg) {
+			seeds = append(seeds, sg)
+		} else {
+			candidates = append(candidates, sg)
+		}
+	}
+
+	p := newSongProfile(seeds)
+
+	type scored struct {
+		song
+		score int
+		plays int
+	}
+
+	var matches []scored
+	s.state.view(func(st *state) {
+		for _, sg := range candidates {
+			if score := p.score(sg); score > 0 {
+				matches = append(matches, scored{
+					song:  sg,
+					score: score,
+					plays: st.playCount(sg.fileRef),
+				})
+			}
+		}
+	})
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+
+		return matches[i].plays > matches[j].plays
+	})
+	if len(matches) > count {
+		matches = matches[:count]
+	}
+
+	refs := make([]fileRef, 0, len(matches))
+	for _, m := range matches {
+		refs = append(refs, m.fileRef)
+	}
+
+	children, err := s.songChildren(u, refs)
+	if err != nil {
+		s.logf("error tagging files from mpd for getting similar songs: %v", err)
+		writeXML(w, errGeneric)
+		return nil, false
+	}
+
+	return children, true
+}
+
+// getTopSongs returns the most played songs by the artist parameter, up to the
+// count parameter.  Songs which have never been played follow those which have.
+func (s *Server) getTopSongs(w http.ResponseWriter, r *http.Request) {
+	qArtist := r.Form.Get("artist")
+	if qArtist == "" {
+		writeXML(w, errMissingParameter)
+		return
+	}
+
+	count, ok := parseSongCount(w, r)
+	if !ok {
+		return
+	}
+
+	u := requestUser(r)
+	all, err := s.listSongs(u)
+	if err != nil {
+		s.logf("error listing files from mpd for getting top songs: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	var songs []song
+	for _, sg := range all {
+		if strings.EqualFold(qArtist, sg.Artist) {
+			songs = append(songs, sg)
+		}
+	}
+
+	plays := make(map[fileRef]int, len(songs))
+	s.state.view(func(st *state) {
+		for _, sg := range songs {
+			plays[sg.fileRef] = st.playCount(sg.fileRef)
+		}
+	})
+
+	sort.SliceStable(songs, func(i, j int) bool {
+		return plays[songs[i].fileRef] > plays[songs[j].fileRef]
+	})
+	if len(songs) > count {
+		songs = songs[:count]
+	}
+
+	refs := make([]fileRef, 0, len(songs))
+	for _, sg := range songs {
+		refs = append(refs, sg.fileRef)
+	}
+
+	children, err := s.songChildren(u, refs)
+	if err != nil {
+		s.logf("error tagging files from mpd for getting top songs: %v", err)
+		writeXML(w, errGeneric)
+		return
+	}
+
+	writeXML(w, func(c *container) {
+		c.TopSongs = &songsContainer{
+			Songs: children,
+		}
+	})
+}
+
+// songChildren returns a child for each file referred to by refs, in order.
+// Files which no longer exist are omitted.
+func (s *Server) songChildren(u *User, refs []fileRef) ([]child, error) {
+	resolved, err := s.resolveRefs(u, refs)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]child, 0, len(refs))
+	for _, ref := range refs {
+		if c, ok := resolved[ref]; ok {
+			out = append(out, c)
+		}
+	}
+
+	return out, nil
+}
+
+// parseSongCount parses the optional count parameter from a request.  If the
+// parameter is invalid, an error is written to w and parseSongCount returns
+// false.
+func parseSongCount(w http.ResponseWriter, r *http.Request) (int, bool) {
+	qCount := r.Form.Get("count")
+	if qCount == "" {
+		return defaultSongCount, true
+	}
+
+	count, err := strconv.Atoi(qCount)
+	if err != nil || count < 0 {
+		writeXML(w, errGeneric)
+		return 0, false
+	}
+
+	return count, true
+}
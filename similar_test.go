@@ -0,0 +1,131 @@
+package mpdsub
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/fhs/gompd/mpd"
+)
+
+// similarDatabase returns a database whose files share some of their tags.
+func similarDatabase() *memoryDatabase {
+	info := map[string]mpd.Attrs{
+		"A/X/1.mp3": {"Artist": "A", "Genre": "Rock", "Date": "2000"},
+		"A/X/2.mp3": {"Artist": "A", "Genre": "Rock", "Date": "2001-06-01"},
+		"A/Y/3.mp3": {"Artist": "A", "Genre": "Jazz", "Date": "1980"},
+		"B/Z/4.mp3": {"Artist": "B", "Genre": "rock", "Date": "2003"},
+		"C/W/5.mp3": {"Artist": "C", "Genre": "Pop", "Date": "1990"},
+	}
+
+	db := &memoryDatabase{
+		files: []string{"A/X/1.mp3", "A/X/2.mp3", "A/Y/3.mp3", "B/Z/4.mp3", "C/W/5.mp3"},
+		attrs: make(map[string]mpd.Attrs),
+		info:  info,
+	}
+	for f := range info {
+		db.attrs[f] = mpd.Attrs{}
+	}
+
+	return db
+}
+
+func TestServer_getSimilarSongs(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		id     string
+		count  string
+		ids    []string
+	}{
+		{
+			name:   "song",
+			target: "/rest/getSimilarSongs.view",
+			id:     "2",
+			ids:    []string{"3", "5", "8"},
+		},
+		{
+			name:   "directory, version 2",
+			target: "/rest/getSimilarSongs2.view",
+			id:     "1",
+			ids:    []string{"5", "8"},
+		},
+		{
+			name:   "count",
+			target: "/rest/getSimilarSongs.view",
+			id:     "1",
+			count:  "1",
+			ids:    []string{"5"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, values := configAuth()
+			values.Set("id", tt.id)
+			if tt.count != "" {
+				values.Set("count", tt.count)
+			}
+
+			withServer(t, similarDatabase(), nil, cfg, func(base string) {
+				c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, tt.target, values))
+
+				songs := c.SimilarSongs
+				if tt.target == "/rest/getSimilarSongs2.view" {
+					songs = c.SimilarSongs2
+				}
+				if songs == nil {
+					t.Fatalf("no similar songs in response: %+v", c)
+				}
+
+				if want, got := tt.ids, childIDs(songs.Songs); !reflect.DeepEqual(want, got) {
+					t.Fatalf("unexpected similar songs:\n- want: %v\n-  got: %v", want, got)
+				}
+			})
+		})
+	}
+}
+
+func TestServer_getTopSongs(t *testing.T) {
+	cfg, values := configAuth()
+
+	withServer(t, similarDatabase(), nil, cfg, func(base string) {
+		scrobble := func(submission string, ids ...string) {
+			v := url.Values{
+				"id":         ids,
+				"submission": []string{submission},
+			}
+			for k := range values {
+				v.Set(k, values.Get(k))
+			}
+
+			c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/scrobble.view", v))
+			if c.Error != nil {
+				t.Fatalf("unexpected error: %+v", c.Error)
+			}
+		}
+
+		scrobble("true", "5", "5")
+		scrobble("true", "3")
+
+		// Now playing notifications are not plays
+		scrobble("false", "2", "2", "2")
+
+		values.Set("artist", "a")
+		c := mustDecodeXML(t, testRequest(t, base, http.MethodGet, "/rest/getTopSongs.view", values))
+
+		if want, got := []string{"5", "3", "2"}, childIDs(c.TopSongs.Songs); !reflect.DeepEqual(want, got) {
+			t.Fatalf("unexpected top songs:\n- want: %v\n-  got: %v", want, got)
+		}
+	})
+}
+
+func childIDs(cs []child) []string {
+	var out []string
+	for _, c := range cs {
+		out = append(out, c.ID)
+	}
+
+	return out
+}
@@ -0,0 +1,184 @@
+package mpdsub
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// stateFile is the name of the file in Config.StateDirectory which stores
+// persisted Server state.
+const stateFile = "state.json"
+
+// A stateStore stores state created by users of the Server, such as
+// bookmarks.  If path is set, state is persisted to a JSON file at that path
+// each time it is modified.  Otherwise, state is only kept in memory.
+type stateStore struct {
+	mu    sync.Mutex
+	path  string
+	state state
+}
+
+// state is the persisted state of a Server.  Per-user state is keyed by
+// user name.
+type state struct {
+	Bookmarks  map[string][]bookmark `json:"bookmarks,omitempty"`
+	PlayQueues map[string]playQueue  `json:"playQueues,omitempty"`
+
+	RadioStations      []radioStation `json:"radioStations,omitempty"`
+	NextRadioStationID int            `json:"nextRadioStationId,omitempty"`
+
+	Podcasts      []podcastChannel `json:"podcasts,omitempty"`
+	NextPodcastID int              `json:"nextPodcastId,omitempty"`
+
+	Shares []share `json:"shares,omitempty"`
+
+	// PlayCounts are the number of times each file has been played, keyed
+	// by folder ID and then by file name.
+	PlayCounts map[int]map[string]int `json:"playCounts,omitempty"`
+}
+
+// A fileRef refers to a file by folder and name rather than by ID, because
+// IDs change when files are added to or removed from MPD's database.
+type fileRef struct {
+	Folder int    `json:"folder"`
+	Name   string `json:"name"`
+}
+
+// newStateStore creates a stateStore which persists state to the file at
+// path, loading any existing state from that file.  If path is empty, state
+// is only kept in memory.
+func newStateStore(path string) (*stateStore, error) {
+	s := &stateStore{path: path}
+	if path == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return s, nil
+	case err != nil:
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &s.state); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// view invokes fn with the current state.  fn must not retain or modify
+// the state.
+func (s *stateStore) view(fn func(st *state)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fn(&s.state)
+}
+
+// update invokes fn to modify a copy of the current state, and then
+// persists the copy.  The current state is only replaced once the copy has
+// been persisted, so a failed update leaves the current state unchanged.
+func (s *stateStore) update(fn func(st *state)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Copy the state through JSON, which also copies the maps and slices
+	// it contains, so that fn cannot modify the current state
+	b, err := json.Marshal(s.state)
+	if err != nil {
+		return err
+	}
+
+	var next state
+	if err := json.Unmarshal(b, &next); err != nil {
+		return err
+	}
+
+	fn(&next)
+
+	if s.path != "" {
+		if err := s.write(next); err != nil {
+			return err
+		}
+	}
+
+	s.state = next
+	return nil
+}
+
+// write persists st to the stateStore's file.
+func (s *stateStore) write(st state) error {
+	b, err := json.MarshalIndent(st, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it, so that a crash cannot leave
+	// behind a partially written state file
+	f, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), s.path)
+}
+
+// resolveRefs finds the files referred to by refs in their folders' current
+// indexes.  It returns a child for each file which still exists and which u
+// may access, keyed by reference.
+func (s *Server) resolveRefs(u *User, refs []fileRef) (map[fileRef]child, error) {
+	// Index each folder at most once, no matter how many references
+	// refer to it
+	indexes := make(map[int][]indexedFile)
+
+	out := make(map[fileRef]child, len(refs))
+	for _, ref := range refs {
+		if _, ok := out[ref]; ok {
+			continue
+		}
+
+		folder, ok := s.lookupFolder(ref.Folder)
+		if !ok {
+			continue
+		}
+
+		files, ok := indexes[folder.ID]
+		if !ok {
+			var err error
+			files, err = folder.index()
+			if err != nil {
+				return nil, err
+			}
+
+			indexes[folder.ID] = files
+		}
+
+		file, ok := findFile(u, files, ref.Name)
+		if !ok {
+			continue
+		}
+
+		tagged, err := tagFiles(folder.db, []indexedFile{file})
+		if err != nil {
+			return nil, err
+		}
+
+		out[ref] = newChild(folder, tagged[0])
+	}
+
+	return out, nil
+}
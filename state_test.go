@@ -0,0 +1,53 @@
+package mpdsub
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_stateStore_updateFailed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mpdsub-state")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newStateStore(filepath.Join(dir, stateFile))
+	if err != nil {
+		t.Fatalf("failed to create state store: %v", err)
+	}
+
+	if err := s.update(func(st *state) {
+		st.Bookmarks = map[string][]bookmark{"test": {{Position: 1000}}}
+	}); err != nil {
+		t.Fatalf("failed to update state: %v", err)
+	}
+
+	// Removing the directory causes the next write to fail
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("failed to remove temporary directory: %v", err)
+	}
+
+	err = s.update(func(st *state) {
+		st.Bookmarks["test"][0].Position = 2000
+		st.Bookmarks["other"] = nil
+		st.NextRadioStationID++
+	})
+	if err == nil {
+		t.Fatal("expected an error when the state cannot be written")
+	}
+
+	s.view(func(st *state) {
+		if want, got := 1, len(st.Bookmarks); want != got {
+			t.Fatalf("unexpected number of bookmark users:\n- want: %v\n-  got: %v", want, got)
+		}
+		if want, got := int64(1000), st.Bookmarks["test"][0].Position; want != got {
+			t.Fatalf("unexpected bookmark position:\n- want: %v\n-  got: %v", want, got)
+		}
+		if want, got := 0, st.NextRadioStationID; want != got {
+			t.Fatalf("unexpected next radio station ID:\n- want: %v\n-  got: %v", want, got)
+		}
+	})
+}
@@ -0,0 +1,266 @@
+package mpdsub
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Transcoder is a type which can transcode media files into another format,
+// so they can be streamed to Subsonic clients at a lower bitrate.
+type Transcoder interface {
+	// Supports reports whether the Transcoder can produce media in the
+	// input format, such as "mp3" or "opus".
+	Supports(format string) bool
+
+	// Transcode reads media from r and returns a stream of media transcoded
+	// using the input options.  The stream must be closed by the caller.
+	// Canceling ctx stops transcoding.
+	Transcode(ctx context.Context, r io.Reader, opts TranscodeOptions) (io.ReadCloser, error)
+}
+
+// TranscodeOptions specifies options for a Transcoder.
+type TranscodeOptions struct {
+	// Format specifies the target media format, such as "mp3" or "opus".
+	Format string
+
+	// BitRate specifies the target bitrate in kbps.  If BitRate is 0,
+	// a Transcoder chooses its own default.
+	BitRate int
+
+	// Offset specifies the position in the input media at which
+	// transcoding should begin.
+	Offset time.Duration
+
+	// Duration specifies an optional length of media to transcode,
+	// beginning at Offset.  If Duration is 0, media is transcoded until
+	// the end of the input.
+	Duration time.Duration
+}
+
+var _ Transcoder = &CommandTranscoder{}
+
+// A CommandTranscoder is a Transcoder which transcodes media by piping it
+// through an external encoder command, such as ffmpeg.  Media is written to
+// the command's standard input, and transcoded media is read from its
+// standard output.
+type CommandTranscoder struct {
+	// Commands maps target formats to the command and arguments used to
+	// produce them.  Each argument may contain the following placeholders,
+	// which are replaced before the command is run:
+	//  - {bitrate}: target bitrate in kbps
+	//  - {offset}: start offset in seconds, with millisecond precision
+	//  - {duration}: length to transcode in seconds, with millisecond
+	//    precision, or the remaining length of the input if unspecified
+	//
+	// For example, an ffmpeg command for MP3:
+	//  ffmpeg -ss {offset} -i pipe:0 -map 0:a -b:a {bitrate}k -f mp3 pipe:1
+	//
+	// The "hls" format produces HLS segments, which must be MPEG transport
+	// streams whose timestamps begin at {offset}:
+	//  ffmpeg -ss {offset} -t {duration} -i pipe:0 -map 0:a -c:a aac
+	//    -b:a {bitrate}k -output_ts_offset {offset} -f mpegts pipe:1
+	Commands map[string][]string
+
+	// DefaultBitRate specifies the bitrate in kbps used when the
+	// TranscodeOptions do not specify one.
+	DefaultBitRate int
+}
+
+// Supports implements Transcoder.
+func (t *CommandTranscoder) Supports(format string) bool {
+	args, ok := t.Commands[format]
+	return ok && len(args) > 0
+}
+
+// Transcode implements Transcoder.
+func (t *CommandTranscoder) Transcode(ctx context.Context, r io.Reader, opts TranscodeOptions) (io.ReadCloser, error) {
+	if !t.Supports(opts.Format) {
+		return nil, errors.New("unsupported transcoding format: " + opts.Format)
+	}
+
+	bitRate := opts.BitRate
+	if bitRate == 0 {
+		bitRate = t.DefaultBitRate
+	}
+
+	// Encoders require a concrete duration, so use one long enough for any
+	// media to indicate the remainder of the input
+	duration := opts.Duration
+	if duration == 0 {
+		duration = 365 * 24 * time.Hour
+	}
+
+	rep := strings.NewReplacer(
+		"{bitrate}", strconv.Itoa(bitRate),
+		"{offset}", seconds(opts.Offset),
+		"{duration}", seconds(duration),
+	)
+
+	tmpl := t.Commands[opts.Format]
+	args := make([]string, 0, len(tmpl))
+	for _, a := range tmpl {
+		args = append(args, rep.Replace(a))
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = r
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return &commandReadCloser{
+		ReadCloser: stdout,
+		cmd:        cmd,
+	}, nil
+}
+
+// seconds formats d as a number of seconds for use in a CommandTranscoder
+// argument.
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64)
+}
+
+// A commandReadCloser is an io.ReadCloser which reads from a command's
+// standard output, and waits for the command to exit when closed.
+type commandReadCloser struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+// Close closes the command's standard output and waits for it to exit.
+func (rc *commandReadCloser) Close() error {
+	_ = rc.ReadCloser.Close()
+	return rc.cmd.Wait()
+}
+
+// transcodeOptions determines if a file with the input extension should be
+// transcoded to satisfy the requested format, maximum bitrate, and time
+// offset.  If so, it returns the options to pass to t and true.
+func transcodeOptions(t Transcoder, ext string, format string, maxBitRate int, offset time.Duration, defaultFormat string, defaultBitRate int) (TranscodeOptions, bool) {
+	if t == nil || format == "raw" {
+		return TranscodeOptions{}, false
+	}
+
+	// A bitrate limit or time offset with no explicit format uses the
+	// default format
+	if format == "" && (maxBitRate > 0 || offset > 0) {
+		format = defaultFormat
+	}
+
+	// No format requested, or the file already matches and no bitrate
+	// limit or time offset was requested
+	if format == "" || (format == ext && maxBitRate == 0 && offset == 0) {
+		return TranscodeOptions{}, false
+	}
+
+	// Fall back to the original file if the format cannot be produced
+	if !t.Supports(format) {
+		return TranscodeOptions{}, false
+	}
+
+	bitRate := maxBitRate
+	if bitRate == 0 {
+		bitRate = defaultBitRate
+	}
+
+	return TranscodeOptions{
+		Format:  format,
+		BitRate: bitRate,
+		Offset:  offset,
+	}, true
+}
+
+// parseSeconds parses a non-negative, possibly fractional, number of seconds
+// from a request parameter.  An empty parameter is treated as zero.
+func parseSeconds(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	secs, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if secs < 0 {
+		return 0, errors.New("negative number of seconds: " + s)
+	}
+
+	return time.Duration(secs * float64(time.Second)), nil
+}
+
+// estimateLength estimates the length in bytes of media with the input
+// duration, transcoded at the input bitrate in kbps.
+func estimateLength(d time.Duration, bitRate int) int64 {
+	if d <= 0 || bitRate <= 0 {
+		return 0
+	}
+
+	return int64(d.Seconds() * float64(bitRate) * 1000 / 8)
+}
+
+// A paddedReader reads exactly N bytes from R, truncating R's output or
+// padding it with zero bytes as needed.
+type paddedReader struct {
+	R io.Reader
+	N int64
+
+	eof bool
+}
+
+// Read implements io.Reader.
+func (p *paddedReader) Read(b []byte) (int, error) {
+	if p.N <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > p.N {
+		b = b[:p.N]
+	}
+
+	var n int
+	if !p.eof {
+		var err error
+		n, err = p.R.Read(b)
+		switch {
+		case err == io.EOF:
+			p.eof = true
+		case err != nil:
+			return n, err
+		}
+	}
+
+	// Once R is exhausted, fill the remainder with zero bytes
+	if p.eof && n == 0 {
+		for i := range b {
+			b[i] = 0
+		}
+		n = len(b)
+	}
+
+	p.N -= int64(n)
+	return n, nil
+}
+
+// formatContentType returns the MIME type of a media format.
+func formatContentType(format string) string {
+	if format == hlsFormat {
+		return contentTypeTS
+	}
+
+	if ct := mime.TypeByExtension("." + format); ct != "" {
+		return ct
+	}
+
+	return "application/octet-stream"
+}
@@ -0,0 +1,135 @@
+package mpdsub
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommandTranscoder(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skipf("skipping, sh not found: %v", err)
+	}
+
+	tr := &CommandTranscoder{
+		Commands: map[string][]string{
+			"mp3": {"sh", "-c", "printf '{bitrate}:{offset}:'; cat"},
+		},
+		DefaultBitRate: 192,
+	}
+
+	tests := []struct {
+		name string
+		opts TranscodeOptions
+
+		ok  bool
+		out string
+	}{
+		{
+			name: "unsupported format",
+			opts: TranscodeOptions{Format: "opus"},
+		},
+		{
+			name: "default bitrate",
+			opts: TranscodeOptions{Format: "mp3"},
+			ok:   true,
+			out:  "192:0.000:hello",
+		},
+		{
+			name: "bitrate",
+			opts: TranscodeOptions{Format: "mp3", BitRate: 128},
+			ok:   true,
+			out:  "128:0.000:hello",
+		},
+		{
+			name: "offset",
+			opts: TranscodeOptions{Format: "mp3", Offset: 1500 * time.Millisecond},
+			ok:   true,
+			out:  "192:1.500:hello",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if want, got := tt.ok, tr.Supports(tt.opts.Format); want != got {
+				t.Fatalf("unexpected supported format:\n- want: %v\n-  got: %v", want, got)
+			}
+
+			rc, err := tr.Transcode(context.Background(), strings.NewReader("hello"), tt.opts)
+			if err != nil {
+				if tt.ok {
+					t.Fatalf("failed to transcode: %v", err)
+				}
+
+				return
+			}
+			if !tt.ok {
+				t.Fatal("expected an error, but none occurred")
+			}
+
+			b, err := ioutil.ReadAll(rc)
+			if err != nil {
+				t.Fatalf("failed to read transcoded output: %v", err)
+			}
+			if err := rc.Close(); err != nil {
+				t.Fatalf("failed to close transcoder: %v", err)
+			}
+
+			if want, got := tt.out, string(b); want != got {
+				t.Fatalf("unexpected transcoded output:\n- want: %q\n-  got: %q", want, got)
+			}
+		})
+	}
+}
+
+func Test_paddedReader(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		n    int64
+		out  string
+	}{
+		{
+			name: "exact",
+			in:   "hello",
+			n:    5,
+			out:  "hello",
+		},
+		{
+			name: "truncated",
+			in:   "hello",
+			n:    2,
+			out:  "he",
+		},
+		{
+			name: "padded",
+			in:   "hello",
+			n:    8,
+			out:  "hello\x00\x00\x00",
+		},
+		{
+			name: "empty",
+			n:    2,
+			out:  "\x00\x00",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, err := ioutil.ReadAll(&paddedReader{
+				R: strings.NewReader(tt.in),
+				N: tt.n,
+			})
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+
+			if want, got := tt.out, string(b); want != got {
+				t.Fatalf("unexpected output:\n- want: %q\n-  got: %q", want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package mpdsub
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// A Role is a Subsonic user role, which grants a user permission to use a
+// group of Subsonic API endpoints.  Roles may be combined using bitwise OR.
+type Role int
+
+// Possible Role values.  RoleAdmin implies every other role.
+const (
+	RoleStream Role = 1 << iota
+	RoleDownload
+	RoleJukebox
+	RolePlaylist
+	RoleCoverArt
+	RoleSettings
+	RoleAdmin
+	RolePodcast
+	RoleShare
+)
+
+// A User is a Subsonic user which may authenticate to a Server.
+type User struct {
+	// Credentials which a Subsonic client must provide to authenticate
+	// as this user.  If Password is empty, the user may only authenticate
+	// using an API key.
+	Name     string
+	Password string
+
+	// APIKeys specifies an optional set of OpenSubsonic API keys which
+	// may be used to authenticate as this user, hashed using HashAPIKey.
+	// Removing a hash from APIKeys revokes the associated key.
+	APIKeys []string
+
+	// Roles specifies the set of operations this user is permitted to
+	// perform.
+	Roles Role
+
+	// Directories specifies an optional set of top-level directories in
+	// the music directory which this user may browse and stream.  If empty,
+	// the user may access the entire music directory.
+	Directories []string
+}
+
+// GenerateAPIKey generates a new random API key for a User.  Only the hash
+// of the key produced by HashAPIKey should be stored in User.APIKeys.
+func GenerateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// HashAPIKey hashes an API key for storage in User.APIKeys.
+func HashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// can determines if a User has been granted role.
+func (u *User) can(role Role) bool {
+	return u.Roles&RoleAdmin != 0 || u.Roles&role == role
+}
+
+// allowed determines if a User may access the file or directory with the
+// input name, relative to the music directory.
+func (u *User) allowed(name string) bool {
+	if len(u.Directories) == 0 {
+		return true
+	}
+
+	top := strings.SplitN(name, string(os.PathSeparator), 2)[0]
+	for _, d := range u.Directories {
+		if d == top {
+			return true
+		}
+	}
+
+	return false
+}
+
+// A contextKey is a key used to store values in a request's context.
+type contextKey int
+
+const (
+	// userKey stores the authenticated *User for a request.
+	userKey contextKey = iota
+)
+
+// withUser returns a copy of r which carries the authenticated User u.
+func withUser(r *http.Request, u *User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey, u))
+}
+
+// requestUser returns the authenticated User for r.  It must only be called
+// from handlers served after authentication.
+func requestUser(r *http.Request) *User {
+	return r.Context().Value(userKey).(*User)
+}
+
+// requireRole wraps fn so that it is only invoked for users who have
+// been granted role.  All other users receive a Subsonic authorization error.
+func (s *Server) requireRole(role Role, fn http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requestUser(r).can(role) {
+			writeXML(w, errNotAuthorized)
+			return
+		}
+
+		fn(w, r)
+	}
+}
@@ -1,9 +1,12 @@
 package mpdsub
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"io"
 	"net/http"
+	"regexp"
+	"time"
 )
 
 const (
@@ -11,6 +14,10 @@ const (
 	xmlNS = "http://subsonic.org/restapi"
 	// Version is the emulated Subsonic API version
 	apiVersion = "1.14.0"
+
+	// Server type and version reported to OpenSubsonic clients
+	serverType    = "mpdsub"
+	serverVersion = "0.1.0"
 )
 
 const (
@@ -19,11 +26,38 @@ const (
 	statusFailed = "failed"
 
 	// Possible status codes.
-	codeGeneric          = 0
-	codeMissingParameter = 10
-	codeUnauthorized     = 40
+	codeGeneric               = 0
+	codeMissingParameter      = 10
+	codeClientVersion         = 20
+	codeServerVersion         = 30
+	codeUnauthorized          = 40
+	codeTokenAuthNotSupported = 41
+	codeConflictingAuth       = 43
+	codeInvalidAPIKey         = 44
+	codeNotAuthorized         = 50
+	codeNotFound              = 70
 )
 
+// errClientVersion indicates that a client uses an older, incompatible
+// version of the Subsonic API.
+func errClientVersion(c *container) {
+	c.Status = statusFailed
+	c.Error = &subsonicError{
+		Code:    20,
+		Message: "Incompatible Subsonic REST protocol version. Client must upgrade.",
+	}
+}
+
+// errServerVersion indicates that a client uses a newer, incompatible
+// version of the Subsonic API.
+func errServerVersion(c *container) {
+	c.Status = statusFailed
+	c.Error = &subsonicError{
+		Code:    30,
+		Message: "Incompatible Subsonic REST protocol version. Server must upgrade.",
+	}
+}
+
 // errUnauthorized indicates an incorrect username or password.
 func errUnauthorized(c *container) {
 	c.Status = statusFailed
@@ -33,6 +67,64 @@ func errUnauthorized(c *container) {
 	}
 }
 
+// errTokenAuthNotSupported indicates that token authentication is not
+// supported for a user, because the user has no password.
+func errTokenAuthNotSupported(c *container) {
+	c.Status = statusFailed
+	c.Error = &subsonicError{
+		Code:    41,
+		Message: "Token authentication not supported for this user.",
+	}
+}
+
+// errConflictingAuth indicates that more than one authentication method was
+// provided with a request.
+func errConflictingAuth(c *container) {
+	c.Status = statusFailed
+	c.Error = &subsonicError{
+		Code:    43,
+		Message: "Multiple conflicting authentication mechanisms provided.",
+	}
+}
+
+// errInvalidAPIKey indicates an unknown or revoked API key.
+func errInvalidAPIKey(c *container) {
+	c.Status = statusFailed
+	c.Error = &subsonicError{
+		Code:    44,
+		Message: "Invalid API key.",
+	}
+}
+
+// errNotAuthorized indicates that an authenticated user lacks the role
+// required to perform an operation.
+func errNotAuthorized(c *container) {
+	c.Status = statusFailed
+	c.Error = &subsonicError{
+		Code:    50,
+		Message: "User is not authorized for the given operation.",
+	}
+}
+
+// errNotFound indicates that the requested data was not found.
+func errNotFound(c *container) {
+	c.Status = statusFailed
+	c.Error = &subsonicError{
+		Code:    70,
+		Message: "The requested data was not found.",
+	}
+}
+
+// errPodcastsNotConfigured indicates that podcasts are not configured for
+// the Server, so no podcast data can be found.
+func errPodcastsNotConfigured(c *container) {
+	c.Status = statusFailed
+	c.Error = &subsonicError{
+		Code:    70,
+		Message: "Podcasts are not configured on this server.",
+	}
+}
+
 // errMissingParameter indicates a missing required parameter.
 func errMissingParameter(c *container) {
 	c.Status = statusFailed
@@ -52,123 +144,386 @@ func errGeneric(c *container) {
 }
 
 const (
-	// Content-Type header name and XML content type.
-	contentType    = "Content-Type"
-	contentTypeXML = "text/xml; charset=utf-8"
+	// Content-Type header name and response content types.
+	contentType      = "Content-Type"
+	contentTypeXML   = "text/xml; charset=utf-8"
+	contentTypeJSON  = "application/json; charset=utf-8"
+	contentTypeJSONP = "application/javascript; charset=utf-8"
 )
 
-// writeXML writes an XML body to w after modifying it using the input function.
+const (
+	// Response formats which may be requested using the f parameter.
+	formatXML   = "xml"
+	formatJSON  = "json"
+	formatJSONP = "jsonp"
+)
+
+// A formatWriter is a http.ResponseWriter which carries the response format
+// requested by a client, so that writeXML can encode responses in that format.
+type formatWriter struct {
+	http.ResponseWriter
+
+	format   string
+	callback string
+}
+
+// writeXML writes a response body to w after modifying it using the input
+// function.  The body is XML unless w is a formatWriter which requests JSON
+// or JSONP.
 func writeXML(w io.Writer, fn func(c *container)) {
 	c := &container{
-		XMLNS:   xmlNS,
-		Status:  statusOK,
-		Version: apiVersion,
+		XMLNS:         xmlNS,
+		Status:        statusOK,
+		Version:       apiVersion,
+		Type:          serverType,
+		ServerVersion: serverVersion,
+		OpenSubsonic:  true,
 	}
 
 	if fn != nil {
 		fn(c)
 	}
 
+	format := formatXML
+	var callback string
+	if fw, ok := w.(*formatWriter); ok {
+		format, callback = fw.format, fw.callback
+	}
+
+	// JSONP requires a callback, so fall back to plain JSON without one.
+	// The callback is written into a script, so only identifiers are
+	// permitted, to prevent script injection.
+	if format == formatJSONP && !jsonpCallback.MatchString(callback) {
+		format = formatJSON
+	}
+
+	ct := contentTypeXML
+	switch format {
+	case formatJSON:
+		ct = contentTypeJSON
+	case formatJSONP:
+		ct = contentTypeJSONP
+	}
+
 	// Set HTTP content type if available
 	if rw, ok := w.(http.ResponseWriter); ok {
-		rw.Header().Set(contentType, contentTypeXML)
+		rw.Header().Set(contentType, ct)
 	}
 
-	_ = xml.NewEncoder(w).Encode(c)
+	// JSON responses wrap the container in a single top-level object
+	v := struct {
+		Response *container `json:"subsonic-response"`
+	}{Response: c}
+
+	switch format {
+	case formatJSON:
+		_ = json.NewEncoder(w).Encode(v)
+	case formatJSONP:
+		_, _ = io.WriteString(w, callback+"(")
+		_ = json.NewEncoder(w).Encode(v)
+		_, _ = io.WriteString(w, ");")
+	default:
+		_ = xml.NewEncoder(w).Encode(c)
+	}
 }
 
+// jsonpCallback matches the JavaScript identifiers, optionally separated by
+// dots, which are permitted as a JSONP callback.
+var jsonpCallback = regexp.MustCompile(`^[A-Za-z_$][\w$]*(?:\.[A-Za-z_$][\w$]*)*$`)
+
 // A container is the top-level emulated Subsonic response.
 type container struct {
 	// Top-level container name.
-	XMLName xml.Name `xml:"subsonic-response"`
+	XMLName xml.Name `xml:"subsonic-response" json:"-"`
 
 	// Attributes which are always present.
-	XMLNS   string `xml:"xmlns,attr"`
-	Status  string `xml:"status,attr"`
-	Version string `xml:"version,attr"`
+	XMLNS   string `xml:"xmlns,attr" json:"-"`
+	Status  string `xml:"status,attr" json:"status"`
+	Version string `xml:"version,attr" json:"version"`
 
-	// Error, returned on failures.
-	Error *subsonicError
+	// OpenSubsonic attributes which identify the server.
+	Type          string `xml:"type,attr" json:"type"`
+	ServerVersion string `xml:"serverVersion,attr" json:"serverVersion"`
+	OpenSubsonic  bool   `xml:"openSubsonic,attr" json:"openSubsonic"`
 
-	Indexes        *indexesContainer
-	License        *license
-	MusicDirectory *musicDirectoryContainer
-	MusicFolders   *musicFoldersContainer
+	// Error, returned on failures.
+	Error *subsonicError `json:"error,omitempty"`
+
+	AlbumInfo             *albumInfo                      `xml:"albumInfo" json:"albumInfo,omitempty"`
+	ArtistInfo            *artistInfo                     `xml:"artistInfo" json:"artistInfo,omitempty"`
+	ArtistInfo2           *artistInfo                     `xml:"artistInfo2" json:"artistInfo2,omitempty"`
+	Bookmarks             *bookmarksContainer             `json:"bookmarks,omitempty"`
+	Indexes               *indexesContainer               `json:"indexes,omitempty"`
+	InternetRadioStations *internetRadioStationsContainer `json:"internetRadioStations,omitempty"`
+	License               *license                        `json:"license,omitempty"`
+	Lyrics                *lyricsContainer                `json:"lyrics,omitempty"`
+	LyricsList            *lyricsListContainer            `json:"lyricsList,omitempty"`
+	MusicDirectory        *musicDirectoryContainer        `json:"directory,omitempty"`
+	MusicFolders          *musicFoldersContainer          `json:"musicFolders,omitempty"`
+	NewestPodcasts        *newestPodcastsContainer        `json:"newestPodcasts,omitempty"`
+	PlayQueue             *playQueueContainer             `json:"playQueue,omitempty"`
+	Podcasts              *podcastsContainer              `json:"podcasts,omitempty"`
+	Shares                *sharesContainer                `json:"shares,omitempty"`
+	SimilarSongs          *songsContainer                 `xml:"similarSongs" json:"similarSongs,omitempty"`
+	SimilarSongs2         *songsContainer                 `xml:"similarSongs2" json:"similarSongs2,omitempty"`
+	TopSongs              *songsContainer                 `xml:"topSongs" json:"topSongs,omitempty"`
+
+	OpenSubsonicExtensions []openSubsonicExtension `xml:"openSubsonicExtensions" json:"openSubsonicExtensions,omitempty"`
 }
 
 // A subsonicError contains a Subsonic error, with status code and message.
 type subsonicError struct {
-	XMLName xml.Name `xml:"error,omitempty"`
+	XMLName xml.Name `xml:"error,omitempty" json:"-"`
 
-	Code    int    `xml:"code,attr"`
-	Message string `xml:"message,attr"`
+	Code    int    `xml:"code,attr" json:"code"`
+	Message string `xml:"message,attr" json:"message"`
 }
 
 // A license is a Subsonic license structure.
 type license struct {
-	XMLName xml.Name `xml:"license,omitempty"`
+	XMLName xml.Name `xml:"license,omitempty" json:"-"`
 
-	Valid bool `xml:"valid,attr"`
+	Valid bool `xml:"valid,attr" json:"valid"`
 }
 
 // A musicFoldersContainer contains a list of emulated Subsonic music folders.
 type musicFoldersContainer struct {
-	XMLName xml.Name `xml:"musicFolders,omitempty"`
+	XMLName xml.Name `xml:"musicFolders,omitempty" json:"-"`
 
-	MusicFolders []musicFolder `xml:"musicFolder"`
+	MusicFolders []musicFolder `xml:"musicFolder" json:"musicFolder,omitempty"`
 }
 
 // A musicFolder represents an emulated Subsonic music folder.
 type musicFolder struct {
-	ID   int    `xml:"id,attr"`
-	Name string `xml:"name,attr"`
+	ID   int    `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
 }
 
 // indexesContainer represents a Subsonic indexes container.
 type indexesContainer struct {
-	XMLName xml.Name `xml:"indexes,omitempty"`
+	XMLName xml.Name `xml:"indexes,omitempty" json:"-"`
 
-	LastModified int64   `xml:"lastModified,attr"`
-	Indexes      []index `xml:"index"`
+	LastModified int64   `xml:"lastModified,attr" json:"lastModified"`
+	Indexes      []index `xml:"index" json:"index,omitempty"`
 }
 
 // An index represents an alphabetical Subsonic index.
 type index struct {
-	XMLName xml.Name `xml:"index"`
+	XMLName xml.Name `xml:"index" json:"-"`
 
-	Name string `xml:"name,attr"`
+	Name string `xml:"name,attr" json:"name"`
 
-	Artists []artist `xml:"artist"`
+	Artists []artist `xml:"artist" json:"artist,omitempty"`
 }
 
 // An artist represents an emulated Subsonic artist.
 type artist struct {
-	XMLName xml.Name `xml:"artist,omitempty"`
+	XMLName xml.Name `xml:"artist,omitempty" json:"-"`
 
-	Name string `xml:"name,attr"`
-	ID   string `xml:"id,attr"`
+	Name string `xml:"name,attr" json:"name"`
+	ID   string `xml:"id,attr" json:"id"`
 }
 
 // A musicDirectoryContainer contains a list of emulated Subsonic music folders.
 type musicDirectoryContainer struct {
-	XMLName xml.Name `xml:"directory,omitempty"`
+	XMLName xml.Name `xml:"directory,omitempty" json:"-"`
 
-	ID   string `xml:"id,attr"`
-	Name string `xml:"name,attr"`
+	ID   string `xml:"id,attr" json:"id"`
+	Name string `xml:"name,attr" json:"name"`
 
-	Children []child `xml:"child"`
+	Children []child `xml:"child" json:"child,omitempty"`
 }
 
 // A child is any item displayed to Subsonic when browsing using getMusicDirectory.
 type child struct {
-	XMLName xml.Name `xml:"child,omitempty"`
-
-	ID       string `xml:"id,attr"`
-	Album    string `xml:"album,attr"`
-	Artist   string `xml:"artist,attr"`
-	CoverArt int    `xml:"coverArt,attr"`
-	Created  string `xml:"created,attr"`
-	IsDir    bool   `xml:"isDir,attr"`
-	Suffix   string `xml:"suffix,attr"`
-	Title    string `xml:"title,attr"`
+	ID       string `xml:"id,attr" json:"id"`
+	Album    string `xml:"album,attr" json:"album"`
+	Artist   string `xml:"artist,attr" json:"artist"`
+	CoverArt int    `xml:"coverArt,attr" json:"coverArt"`
+	Created  string `xml:"created,attr" json:"created"`
+	IsDir    bool   `xml:"isDir,attr" json:"isDir"`
+	Suffix   string `xml:"suffix,attr" json:"suffix"`
+	Title    string `xml:"title,attr" json:"title"`
+}
+
+// A bookmarksContainer contains a list of a user's bookmarks.
+type bookmarksContainer struct {
+	XMLName xml.Name `xml:"bookmarks,omitempty" json:"-"`
+
+	Bookmarks []bookmarkEntry `xml:"bookmark" json:"bookmark,omitempty"`
+}
+
+// A bookmarkEntry is a position saved by a user within a file, along with
+// the file itself.
+type bookmarkEntry struct {
+	Position int64     `xml:"position,attr" json:"position"`
+	Username string    `xml:"username,attr" json:"username"`
+	Comment  string    `xml:"comment,attr,omitempty" json:"comment,omitempty"`
+	Created  time.Time `xml:"created,attr" json:"created"`
+	Changed  time.Time `xml:"changed,attr" json:"changed"`
+
+	Entry child `xml:"entry" json:"entry"`
+}
+
+// A playQueueContainer contains a user's saved play queue.
+type playQueueContainer struct {
+	XMLName xml.Name `xml:"playQueue,omitempty" json:"-"`
+
+	Current   string    `xml:"current,attr,omitempty" json:"current,omitempty"`
+	Position  int64     `xml:"position,attr" json:"position"`
+	Username  string    `xml:"username,attr" json:"username"`
+	Changed   time.Time `xml:"changed,attr" json:"changed"`
+	ChangedBy string    `xml:"changedBy,attr" json:"changedBy"`
+
+	Entries []child `xml:"entry" json:"entry,omitempty"`
+}
+
+// A lyricsContainer contains plain text lyrics for a song.
+type lyricsContainer struct {
+	XMLName xml.Name `xml:"lyrics,omitempty" json:"-"`
+
+	Artist string `xml:"artist,attr,omitempty" json:"artist,omitempty"`
+	Title  string `xml:"title,attr,omitempty" json:"title,omitempty"`
+	Value  string `xml:",chardata" json:"value"`
+}
+
+// A lyricsListContainer contains all of the lyrics available for a song.
+type lyricsListContainer struct {
+	XMLName xml.Name `xml:"lyricsList,omitempty" json:"-"`
+
+	StructuredLyrics []structuredLyrics `xml:"structuredLyrics" json:"structuredLyrics"`
+}
+
+// A structuredLyrics element contains lyrics split into lines, which are
+// optionally synchronized with a song.
+type structuredLyrics struct {
+	DisplayArtist string `xml:"displayArtist,attr,omitempty" json:"displayArtist,omitempty"`
+	DisplayTitle  string `xml:"displayTitle,attr,omitempty" json:"displayTitle,omitempty"`
+	Lang          string `xml:"lang,attr" json:"lang"`
+	Offset        int64  `xml:"offset,attr" json:"offset"`
+	Synced        bool   `xml:"synced,attr" json:"synced"`
+
+	Lines []lyricsLineElement `xml:"line" json:"line"`
+}
+
+// A lyricsLineElement is a single line of structured lyrics, with a start
+// time in milliseconds if the lyrics are synchronized.
+type lyricsLineElement struct {
+	Start *int64 `xml:"start,attr,omitempty" json:"start,omitempty"`
+	Value string `xml:",chardata" json:"value"`
+}
+
+// An internetRadioStationsContainer contains a list of internet radio
+// stations.
+type internetRadioStationsContainer struct {
+	XMLName xml.Name `xml:"internetRadioStations,omitempty" json:"-"`
+
+	Stations []internetRadioStation `xml:"internetRadioStation" json:"internetRadioStation,omitempty"`
+}
+
+// An internetRadioStation is an emulated Subsonic internet radio station.
+type internetRadioStation struct {
+	ID          string `xml:"id,attr" json:"id"`
+	Name        string `xml:"name,attr" json:"name"`
+	StreamURL   string `xml:"streamUrl,attr" json:"streamUrl"`
+	HomePageURL string `xml:"homePageUrl,attr,omitempty" json:"homePageUrl,omitempty"`
+}
+
+// A podcastsContainer contains a list of podcast channels.
+type podcastsContainer struct {
+	XMLName xml.Name `xml:"podcasts,omitempty" json:"-"`
+
+	Channels []podcastChannelElement `xml:"channel" json:"channel,omitempty"`
+}
+
+// A podcastChannelElement is an emulated Subsonic podcast channel.
+type podcastChannelElement struct {
+	ID               string `xml:"id,attr" json:"id"`
+	URL              string `xml:"url,attr" json:"url"`
+	Title            string `xml:"title,attr,omitempty" json:"title,omitempty"`
+	Description      string `xml:"description,attr,omitempty" json:"description,omitempty"`
+	OriginalImageURL string `xml:"originalImageUrl,attr,omitempty" json:"originalImageUrl,omitempty"`
+	Status           string `xml:"status,attr" json:"status"`
+	ErrorMessage     string `xml:"errorMessage,attr,omitempty" json:"errorMessage,omitempty"`
+
+	Episodes []podcastEpisodeElement `xml:"episode" json:"episode,omitempty"`
+}
+
+// A newestPodcastsContainer contains the most recently published podcast
+// episodes.
+type newestPodcastsContainer struct {
+	XMLName xml.Name `xml:"newestPodcasts,omitempty" json:"-"`
+
+	Episodes []podcastEpisodeElement `xml:"episode" json:"episode,omitempty"`
+}
+
+// A podcastEpisodeElement is an emulated Subsonic podcast episode.  StreamID
+// is only set once the episode has been downloaded and indexed by MPD.
+type podcastEpisodeElement struct {
+	ID          string `xml:"id,attr" json:"id"`
+	StreamID    string `xml:"streamId,attr,omitempty" json:"streamId,omitempty"`
+	ChannelID   string `xml:"channelId,attr" json:"channelId"`
+	Title       string `xml:"title,attr" json:"title"`
+	Description string `xml:"description,attr,omitempty" json:"description,omitempty"`
+	PublishDate string `xml:"publishDate,attr,omitempty" json:"publishDate,omitempty"`
+	Status      string `xml:"status,attr" json:"status"`
+	ContentType string `xml:"contentType,attr,omitempty" json:"contentType,omitempty"`
+	Suffix      string `xml:"suffix,attr,omitempty" json:"suffix,omitempty"`
+	Size        int64  `xml:"size,attr,omitempty" json:"size,omitempty"`
+}
+
+// A sharesContainer contains a list of shares.
+type sharesContainer struct {
+	XMLName xml.Name `xml:"shares,omitempty" json:"-"`
+
+	Shares []shareElement `xml:"share" json:"share,omitempty"`
+}
+
+// A shareElement is an emulated Subsonic share, along with the files it
+// shares.
+type shareElement struct {
+	ID          string     `xml:"id,attr" json:"id"`
+	URL         string     `xml:"url,attr" json:"url"`
+	Description string     `xml:"description,attr,omitempty" json:"description,omitempty"`
+	Username    string     `xml:"username,attr" json:"username"`
+	Created     time.Time  `xml:"created,attr" json:"created"`
+	Expires     *time.Time `xml:"expires,attr,omitempty" json:"expires,omitempty"`
+	LastVisited *time.Time `xml:"lastVisited,attr,omitempty" json:"lastVisited,omitempty"`
+	VisitCount  int        `xml:"visitCount,attr" json:"visitCount"`
+
+	Entries []child `xml:"entry" json:"entry,omitempty"`
+}
+
+// An artistInfo contains information about an artist.  It is used for both
+// the artistInfo and artistInfo2 elements.
+type artistInfo struct {
+	Biography      string `xml:"biography,omitempty" json:"biography,omitempty"`
+	MusicBrainzID  string `xml:"musicBrainzId,omitempty" json:"musicBrainzId,omitempty"`
+	SmallImageURL  string `xml:"smallImageUrl,omitempty" json:"smallImageUrl,omitempty"`
+	MediumImageURL string `xml:"mediumImageUrl,omitempty" json:"mediumImageUrl,omitempty"`
+	LargeImageURL  string `xml:"largeImageUrl,omitempty" json:"largeImageUrl,omitempty"`
+}
+
+// An albumInfo contains information about an album.
+type albumInfo struct {
+	Notes          string `xml:"notes,omitempty" json:"notes,omitempty"`
+	MusicBrainzID  string `xml:"musicBrainzId,omitempty" json:"musicBrainzId,omitempty"`
+	SmallImageURL  string `xml:"smallImageUrl,omitempty" json:"smallImageUrl,omitempty"`
+	MediumImageURL string `xml:"mediumImageUrl,omitempty" json:"mediumImageUrl,omitempty"`
+	LargeImageURL  string `xml:"largeImageUrl,omitempty" json:"largeImageUrl,omitempty"`
+}
+
+// A songsContainer contains a list of songs.  It is used for the similarSongs,
+// similarSongs2, and topSongs elements.
+type songsContainer struct {
+	Songs []child `xml:"song" json:"song,omitempty"`
+}
+
+// An openSubsonicExtension describes an OpenSubsonic API extension and the
+// versions of it which are supported.
+type openSubsonicExtension struct {
+	XMLName xml.Name `xml:"openSubsonicExtensions" json:"-"`
+
+	Name     string `xml:"name,attr" json:"name"`
+	Versions []int  `xml:"versions" json:"versions"`
 }